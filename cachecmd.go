@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sj14/confible/internal/cache"
+	"github.com/sj14/confible/internal/source"
+)
+
+const cacheUsage = `usage: confible [-cache-file path] cache <command> [arguments]
+
+commands:
+  list [--json] [--show-secrets]       list the cached variables of all ids
+  get <id> <var>                       print the value of a variable
+  set [--secret|--no-secret] <id> <var> <value>
+                                       set the value of a variable, secrets stay secret
+  unset <id> <var>                     remove a variable
+  list-commands <id>                   list the successfully executed commands
+  export [id ...]                      print the variables (of the given ids) as JSON
+  import <file|->                      add the variables of an export`
+
+// runCache runs the cache subcommand with the given arguments on the cache file.
+func runCache(cacheFilepath string, args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(cacheUsage)
+	}
+
+	fs := flag.NewFlagSet("cache "+args[0], flag.ContinueOnError)
+	var (
+		asJSON      = fs.Bool("json", false, "print JSON")
+		showSecrets = fs.Bool("show-secrets", false, "don't mask the values of secret variables")
+		secret      = fs.Bool("secret", false, "mask the value when listing the cache")
+		noSecret    = fs.Bool("no-secret", false, "don't mask the value when listing the cache anymore")
+	)
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	args = append([]string{args[0]}, fs.Args()...)
+
+	// key == command; value == number of arguments, -1 for any number
+	nargs := map[string]int{"list": 0, "get": 2, "set": 3, "unset": 2, "list-commands": 1, "export": -1, "import": 1}
+	n, ok := nargs[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown cache command %q\n%s", args[0], cacheUsage)
+	}
+	if n >= 0 && len(args)-1 != n {
+		return fmt.Errorf("cache %s expects %d arguments, got %d\n%s", args[0], n, len(args)-1, cacheUsage)
+	}
+
+	c, err := cache.Open(cacheFilepath)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	switch args[0] {
+	case "list":
+		if *asJSON {
+			encoder := json.NewEncoder(stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(c.Vars(!*showSecrets))
+		}
+		c.ListVars(stdout, !*showSecrets)
+	case "get":
+		vars := c.LoadVars(args[1])
+		value, ok := vars[args[2]]
+		if !ok {
+			return fmt.Errorf("variable %q of %q is not cached", args[2], args[1])
+		}
+		fmt.Fprintln(stdout, value)
+	case "set":
+		if *secret && *noSecret {
+			return errors.New("--secret and --no-secret can't be combined")
+		}
+		c.UpsertVar(args[1], args[2], args[3])
+		// keeps the flag, e.g. when correcting a prompted secret
+		if *secret || *noSecret {
+			c.SetSecret(args[1], args[2], *secret)
+		}
+		return c.Store()
+	case "unset":
+		if !c.DeleteVar(args[1], args[2]) {
+			return fmt.Errorf("variable %q of %q is not cached", args[2], args[1])
+		}
+		return c.Store()
+	case "list-commands":
+		for _, cmd := range c.Commands(args[1]) {
+			fmt.Fprintln(stdout, cmd)
+		}
+	case "export":
+		return c.Export(stdout, args[1:])
+	case "import":
+		var r io.Reader = os.Stdin
+		if args[1] != source.Stdin {
+			f, err := os.Open(args[1])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		count, err := c.Import(r)
+		if err != nil {
+			return err
+		}
+		if err := c.Store(); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "imported %d variables\n", count)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunCacheSetSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+
+	run := func(args ...string) string {
+		stdout := &bytes.Buffer{}
+		require.NoError(t, runCache(path, args, stdout))
+		return stdout.String()
+	}
+
+	run("set", "--secret", "git", "token", "old")
+	require.Equal(t, "id: git\n---\ntoken: ********\n\n", run("list"))
+
+	// overwriting keeps the secret
+	run("set", "git", "token", "n3w")
+	require.Equal(t, "id: git\n---\ntoken: ********\n\n", run("list"))
+	require.Equal(t, "n3w\n", run("get", "git", "token"))
+
+	run("set", "--no-secret", "git", "token", "n3w")
+	require.Equal(t, "id: git\n---\ntoken: n3w\n\n", run("list"))
+
+	require.Error(t, runCache(path, []string{"set", "--secret", "--no-secret", "git", "token", "x"}, &bytes.Buffer{}))
+}
@@ -0,0 +1,147 @@
+// Package become runs commands as another user with sudo.
+package become
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+var (
+	mu sync.Mutex
+	// password is asked once and reused for all following sudo calls.
+	password string
+)
+
+// Authenticate makes sure sudo can run without asking for a password. The password
+// is only prompted when sudo doesn't already have valid credentials (e.g. NOPASSWD)
+// and then reused to refresh the credentials on later calls.
+func Authenticate(ctx context.Context) error {
+	if runtime.GOOS == "windows" {
+		return errors.New("sudo and become are not supported on windows")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if password == "" {
+		// no password required or credentials still cached by sudo
+		if exec.CommandContext(ctx, "sudo", "-n", "-v").Run() == nil {
+			return nil
+		}
+
+		p, err := prompt(ctx)
+		if err != nil {
+			return fmt.Errorf("failed reading sudo password: %v", err)
+		}
+		password = p
+	}
+
+	stderr := &bytes.Buffer{}
+	c := exec.CommandContext(ctx, "sudo", "-S", "-v", "-p", "")
+	c.Stdin = strings.NewReader(password + "\n")
+	c.Stderr = stderr
+	if err := c.Run(); err != nil {
+		// ask again next time
+		password = ""
+		return fmt.Errorf("sudo authentication failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// Args returns the arguments for running args as the user with sudo.
+// The environment is passed with env, as sudo resets it.
+func Args(user string, env []string, args ...string) []string {
+	result := []string{"sudo", "-n", "-u", user, "--"}
+	if len(env) != 0 {
+		result = append(append(result, "env"), env...)
+	}
+	return append(result, args...)
+}
+
+// Run authenticates and runs args as the user with sudo. The stdin is passed to the
+// command and its stdout is returned.
+func Run(ctx context.Context, user string, stdin io.Reader, args ...string) ([]byte, error) {
+	if err := Authenticate(ctx); err != nil {
+		return nil, err
+	}
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	args = Args(user, nil, args...)
+
+	c := exec.CommandContext(ctx, args[0], args[1:]...)
+	c.Stdin = stdin
+	c.Stdout = stdout
+	c.Stderr = stderr
+
+	if err := c.Run(); err != nil {
+		return nil, fmt.Errorf("failed running '%s': %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// prompt reads the password from the terminal without echoing it. It returns
+// when the context is done, so the echo is restored on interrupts.
+func prompt(ctx context.Context) (string, error) {
+	fmt.Fprint(os.Stderr, "[confible] sudo password: ")
+	defer fmt.Fprintln(os.Stderr)
+
+	// fails when stdin is not a terminal, the password is echoed then
+	if stty("-echo") == nil {
+		defer stty("echo")
+	}
+
+	type result struct {
+		line string
+		err  error
+	}
+	// the read can't be interrupted, it's abandoned when the context is done
+	stdin := os.Stdin
+	done := make(chan result, 1)
+	go func() {
+		line, err := readLine(stdin)
+		done <- result{line, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.line, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// readLine reads a line byte by byte, so no input of later prompts is buffered here.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) && len(line) != 0 {
+				break
+			}
+			return "", err
+		}
+	}
+	return strings.TrimSuffix(string(line), "\r"), nil
+}
+
+func stty(arg string) error {
+	c := exec.Command("stty", arg)
+	c.Stdin = os.Stdin
+	return c.Run()
+}
@@ -0,0 +1,82 @@
+package become
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		user string
+		env  []string
+		args []string
+		want []string
+	}{
+		{
+			name: "without env",
+			user: "root",
+			args: []string{"sh", "-c", "apt-get update"},
+			want: []string{"sudo", "-n", "-u", "root", "--", "sh", "-c", "apt-get update"},
+		},
+		{
+			name: "with env",
+			user: "postgres",
+			env:  []string{"FOO=bar"},
+			args: []string{"sh", "-c", "echo $FOO"},
+			want: []string{"sudo", "-n", "-u", "postgres", "--", "env", "FOO=bar", "sh", "-c", "echo $FOO"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, Args(tt.user, tt.env, tt.args...))
+		})
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{name: "line", input: "secret\nnext", want: "secret"},
+		{name: "crlf", input: "secret\r\n", want: "secret"},
+		{name: "without newline", input: "secret", want: "secret"},
+		{name: "empty", input: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readLine(strings.NewReader(tt.input))
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPromptCanceled(t *testing.T) {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	defer w.Close()
+
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+
+	// nothing is written, the prompt only returns on the canceled context
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = prompt(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -1,7 +1,10 @@
 package cache
 
 import (
+	"bytes"
 	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -9,7 +12,8 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/sj14/confible/internal/confible"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 )
 
 // key == variable name; value == variable value
@@ -18,40 +22,62 @@ type keyValueMap map[string]string
 // key == id
 type variablesMap map[string]keyValueMap
 
-// key == id
-type commandsMap map[string][]confible.Command
+// key == id; value == executed commands (key == hash of the command; value == command)
+type commandsMap map[string]map[string]string
+
+// key == id; value == names of the secret variables
+type secretsMap map[string][]string
+
+// key == id; value == exec lists of the blocks cached by confible versions before the JSON cache
+type legacyCommandsMap map[string][][]string
 
+// mask replaces the values of secret variables in listings.
+const mask = "********"
+
+// Cache contains the variables and executed commands of all confible files. The cache file
+// is locked from Open until Close, concurrent confible runs wait for each other.
 type Cache struct {
 	path      string
 	variables variablesMap
 	commands  commandsMap
+	secrets   secretsMap
+	legacy    legacyCommandsMap
+	// holds the lock, separate from the cache file which is replaced on each store
+	lock *os.File
+}
+
+// Version of the cache file format, increase it on incompatible changes.
+const Version = 1
+
+// cacheJSON is the format of the cache file.
+type cacheJSON struct {
+	Version   int          `json:"version"`
+	Variables variablesMap `json:"variables"`
+	Commands  commandsMap  `json:"commands,omitempty"`
+	Secrets   secretsMap   `json:"secrets,omitempty"`
+	// the commands of the gob cache which were not migrated yet
+	LegacyCommands legacyCommandsMap `json:"legacy_commands,omitempty"`
 }
 
-// I don't want to export the variables, thus a new struct which won't be returned in any public func.
+// cacheGob is the format of the cache file before it was versioned.
+// It's only decoded for migrating old cache files to JSON.
 type cacheGob struct {
 	Variables variablesMap
-	Commands  commandsMap
+	// key == id; value == the successfully executed blocks
+	Commands map[string][]gobCommand
 }
 
-func gobTocache(gobCache cacheGob, cachePath string) Cache {
-	return Cache{
-		path:      cachePath,
-		variables: gobCache.Variables,
-		commands:  gobCache.Commands,
-	}
+// gobCommand is a block of the gob cache, only the commands are migrated.
+type gobCommand struct {
+	Exec []string
 }
 
-func cacheToGob(c Cache) cacheGob {
-	return cacheGob{
-		Variables: c.variables,
-		Commands:  c.commands,
+// UpsertCommand marks the command with the given hash as successfully executed.
+func (c *Cache) UpsertCommand(id, hash, command string) {
+	if c.commands[id] == nil {
+		c.commands[id] = make(map[string]string)
 	}
-}
-
-// store only when we processed all commands!
-// Do not update one after another! All at once!
-func (c *Cache) UpsertCommands(id string, commands []confible.Command) {
-	c.commands[id] = commands
+	c.commands[id][hash] = command
 }
 
 func (c *Cache) UpsertVar(id, name, value string) {
@@ -69,70 +95,156 @@ func GetCacheFilepath() string {
 	return filepath.Join(cacheDir, "confible.cache")
 }
 
-func Prune(fp string) {
-	cacheFile, err := open(fp)
+// Prune removes all variables, secrets and commands from the cache file.
+func Prune(path string) error {
+	c, err := Open(path)
 	if err != nil {
-		log.Fatalf("failed to open cache file: %v", err)
+		return err
 	}
-	defer cacheFile.Close()
+	defer c.Close()
 
-	if err := cacheFile.Truncate(0); err != nil {
-		log.Fatalf("failed cleaning cache file: %v\n", err)
-	}
+	c.variables = make(variablesMap)
+	c.commands = make(commandsMap)
+	c.secrets = make(secretsMap)
+	c.legacy = make(legacyCommandsMap)
+	return c.Store()
 }
 
-// DON'T FORGET TO CLOSE FILE
-func open(cacheFilepath string) (*os.File, error) {
-	// open the cache file
-	cacheFile, err := os.OpenFile(cacheFilepath, os.O_RDWR|os.O_CREATE, 0o666)
+// Open locks and loads the cache file. A missing file results in an empty cache.
+// The lock is released with Close.
+func Open(path string) (*Cache, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed creating cache folder: %v", err)
+	}
+
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0o600)
 	if err != nil {
-		return nil, fmt.Errorf("failed creating cache file (%v): %v", cacheFilepath, err)
+		return nil, fmt.Errorf("failed creating cache lock file: %v", err)
+	}
+	if err := lockFile(lock, false); err != nil {
+		log.Printf("waiting for another confible run to release the cache %q\n", path)
+		if err := lockFile(lock, true); err != nil {
+			lock.Close()
+			return nil, fmt.Errorf("failed locking cache file: %v", err)
+		}
 	}
 
-	return cacheFile, nil
+	c := &Cache{path: path, lock: lock}
+	if err := c.load(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return c, nil
 }
 
-func New(path string) (*Cache, error) {
-	c := &Cache{
-		path: path,
+// Close releases the lock of the cache file.
+func (c *Cache) Close() error {
+	return c.lock.Close()
+}
+
+// ListVars writes the variables of all ids, sorted by id and name.
+// The values of secret variables are masked when maskSecrets is set.
+func (c *Cache) ListVars(w io.Writer, maskSecrets bool) {
+	vars := c.Vars(maskSecrets)
+
+	ids := maps.Keys(vars)
+	slices.Sort(ids)
+	for _, id := range ids {
+		fmt.Fprintf(w, "id: %v\n", id)
+		fmt.Fprintln(w, "---")
+
+		names := maps.Keys(vars[id])
+		slices.Sort(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "%v: %v\n", name, vars[id][name])
+		}
+		fmt.Fprintln(w)
 	}
-	return c, c.load()
 }
 
-func (c *Cache) ListVars() {
+// Vars returns a copy of the variables of all ids.
+// The values of secret variables are masked when maskSecrets is set.
+func (c *Cache) Vars(maskSecrets bool) map[string]map[string]string {
+	vars := make(map[string]map[string]string, len(c.variables))
 	for id, variables := range c.variables {
-		fmt.Printf("id: %v\n", id)
-		fmt.Println("---")
-		for key, value := range variables {
-			fmt.Printf("%v: %v\n", key, value)
+		vars[id] = make(map[string]string, len(variables))
+		for name, value := range variables {
+			if maskSecrets && c.IsSecret(id, name) {
+				value = mask
+			}
+			vars[id][name] = value
 		}
-		fmt.Println()
 	}
+	return vars
 }
 
 func (c *Cache) load() error {
-	cacheFile, err := open(c.path)
-	if err != nil {
-		log.Fatalf("failed to open cache file: %v", err)
+	content, err := os.ReadFile(c.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed reading confible cache: %v", err)
 	}
-	defer cacheFile.Close()
 
-	// read the old cache
-	gobCache := cacheGob{}
-	if err := gob.NewDecoder(cacheFile).Decode(&gobCache); err != nil && err != io.EOF {
-		return fmt.Errorf("failed decoding confible cache: %v", err)
+	decoded, err := decode(content)
+	if err != nil {
+		return fmt.Errorf("failed decoding confible cache (%v): %v", c.path, err)
 	}
-
-	*c = gobTocache(gobCache, c.path)
+	c.variables, c.commands, c.secrets, c.legacy = decoded.Variables, decoded.Commands, decoded.Secrets, decoded.LegacyCommands
 	if c.variables == nil {
 		c.variables = make(variablesMap)
 	}
 	if c.commands == nil {
 		c.commands = make(commandsMap)
 	}
+	if c.secrets == nil {
+		c.secrets = make(secretsMap)
+	}
+	if c.legacy == nil {
+		c.legacy = make(legacyCommandsMap)
+	}
 	return nil
 }
 
+// decode reads the JSON cache or migrates the old gob cache.
+func decode(content []byte) (cacheJSON, error) {
+	if len(bytes.TrimSpace(content)) == 0 {
+		return cacheJSON{}, nil
+	}
+
+	jsonCache, jsonErr := decodeJSON(bytes.NewReader(content))
+	if jsonErr == nil {
+		return jsonCache, nil
+	}
+
+	// cache files before the JSON format
+	gobCache := cacheGob{}
+	if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&gobCache); err != nil {
+		return cacheJSON{}, jsonErr
+	}
+	log.Println("migrating the confible cache to JSON")
+	legacy := make(legacyCommandsMap)
+	for id, blocks := range gobCache.Commands {
+		for _, block := range blocks {
+			legacy[id] = append(legacy[id], block.Exec)
+		}
+	}
+	return cacheJSON{Variables: gobCache.Variables, LegacyCommands: legacy}, nil
+}
+
+// decodeJSON reads a cache file or an export and checks its version.
+func decodeJSON(r io.Reader) (cacheJSON, error) {
+	jsonCache := cacheJSON{}
+	if err := json.NewDecoder(r).Decode(&jsonCache); err != nil {
+		return cacheJSON{}, err
+	}
+	switch {
+	case jsonCache.Version > Version:
+		return cacheJSON{}, fmt.Errorf("version %d is not supported (max. %d), please update confible", jsonCache.Version, Version)
+	case jsonCache.Version < 1:
+		return cacheJSON{}, fmt.Errorf("invalid version %d", jsonCache.Version)
+	}
+	return jsonCache, nil
+}
+
 func (c *Cache) LoadVar(id, varName string) string {
 	return c.variables[id][varName]
 }
@@ -141,30 +253,183 @@ func (c *Cache) LoadVars(id string) map[string]string {
 	return c.variables[id]
 }
 
-func (c *Cache) LoadCommands(id string) []confible.Command {
-	return c.commands[id]
+// DeleteVar removes the variable and returns if it was cached.
+func (c *Cache) DeleteVar(id, name string) bool {
+	if _, ok := c.variables[id][name]; !ok {
+		return false
+	}
+	delete(c.variables[id], name)
+	if len(c.variables[id]) == 0 {
+		delete(c.variables, id)
+	}
+	c.SetSecret(id, name, false)
+	return true
+}
+
+// SetSecret marks the variable as secret or not, secret values are masked in listings.
+func (c *Cache) SetSecret(id, name string, secret bool) {
+	var names []string
+	for _, n := range c.secrets[id] {
+		if n != name {
+			names = append(names, n)
+		}
+	}
+	if secret {
+		names = append(names, name)
+		slices.Sort(names)
+	}
+	if len(names) == 0 {
+		delete(c.secrets, id)
+		return
+	}
+	c.secrets[id] = names
+}
+
+// IsSecret returns if the variable is marked as secret.
+func (c *Cache) IsSecret(id, name string) bool {
+	return slices.Contains(c.secrets[id], name)
 }
 
-func (c *Cache) Store(cacheFilepath string) error {
-	// store the new cache
-	cacheFile, err := open(cacheFilepath)
+// Masker returns a replacer which masks the values of the secret variables of the id.
+func (c *Cache) Masker(id string) *strings.Replacer {
+	var values []string
+	for _, name := range c.secrets[id] {
+		if value := c.variables[id][name]; value != "" {
+			values = append(values, value)
+		}
+	}
+	// longer values first, they might contain shorter ones
+	slices.SortFunc(values, func(a, b string) bool { return len(a) > len(b) })
+
+	var oldnew []string
+	for _, value := range values {
+		oldnew = append(oldnew, value, mask)
+	}
+	return strings.NewReplacer(oldnew...)
+}
+
+// Commands returns the successfully executed commands of the id, sorted alphabetically.
+// The values of secret variables are masked.
+func (c *Cache) Commands(id string) []string {
+	masker := c.Masker(id)
+	var cmds []string
+	for _, cmd := range c.commands[id] {
+		cmds = append(cmds, masker.Replace(cmd))
+	}
+	slices.Sort(cmds)
+	return cmds
+}
+
+// Export writes the variables of the given ids (all when empty) as JSON, which can be
+// imported on another machine. The executed commands are not exported, as they have to
+// run on each machine.
+func (c *Cache) Export(w io.Writer, ids []string) error {
+	export := cacheJSON{
+		Version:   Version,
+		Variables: make(variablesMap),
+		Secrets:   make(secretsMap),
+	}
+	for id, variables := range c.variables {
+		if len(ids) != 0 && !slices.Contains(ids, id) {
+			continue
+		}
+		export.Variables[id] = variables
+		if secrets, ok := c.secrets[id]; ok {
+			export.Secrets[id] = secrets
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(export)
+}
+
+// Import adds the variables of an export, existing variables are overwritten.
+// Returns the number of imported variables.
+func (c *Cache) Import(r io.Reader) (int, error) {
+	imported, err := decodeJSON(r)
 	if err != nil {
-		log.Fatalf("failed to open cache file: %v", err)
+		return 0, fmt.Errorf("failed decoding import: %v", err)
+	}
+
+	count := 0
+	for id, variables := range imported.Variables {
+		for name, value := range variables {
+			c.UpsertVar(id, name, value)
+			c.SetSecret(id, name, slices.Contains(imported.Secrets[id], name))
+			count++
+		}
 	}
-	defer cacheFile.Close()
+	return count, nil
+}
 
-	encoder := gob.NewEncoder(cacheFile)
-	return encoder.Encode(cacheToGob(*c))
+// IsExecuted returns if the command with the given hash was successfully executed.
+func (c *Cache) IsExecuted(id, hash string) bool {
+	_, ok := c.commands[id][hash]
+	return ok
 }
 
-func Clean(path, id string) error {
-	c, err := New(path)
+// MigrateCommands returns if the block with the exec list was successfully executed
+// according to the cache of older confible versions, which only stored the commands
+// of each block. The block is removed from the old commands then and the caller
+// marks its commands as executed with UpsertCommand.
+func (c *Cache) MigrateCommands(id string, exec []string) bool {
+	for i, legacy := range c.legacy[id] {
+		if !slices.Equal(legacy, exec) {
+			continue
+		}
+		c.legacy[id] = append(c.legacy[id][:i], c.legacy[id][i+1:]...)
+		if len(c.legacy[id]) == 0 {
+			delete(c.legacy, id)
+		}
+		return true
+	}
+	return false
+}
+
+// Store writes the cache to a temporary file and replaces the cache file with it,
+// the cache file is never partially written.
+func (c *Cache) Store() error {
+	content, err := json.MarshalIndent(cacheJSON{
+		Version:        Version,
+		Variables:      c.variables,
+		Commands:       c.commands,
+		Secrets:        c.secrets,
+		LegacyCommands: c.legacy,
+	}, "", "  ")
 	if err != nil {
 		return err
 	}
 
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed creating cache file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(content, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed writing cache file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed writing cache file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed writing cache file: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return fmt.Errorf("failed replacing cache file: %v", err)
+	}
+	return nil
+}
+
+// Clean removes the variables and commands of the id.
+func (c *Cache) Clean(id string) error {
 	delete(c.variables, id)
 	delete(c.commands, id)
-
-	return c.Store(path)
+	delete(c.secrets, id)
+	delete(c.legacy, id)
+	return c.Store()
 }
@@ -0,0 +1,223 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateGob(t *testing.T) {
+	// written by confible before the JSON cache for a file with the id "legacy", the
+	// variable "name" and the blocks ["echo install >> /tmp/legacy-count", "echo done"]
+	// and ["echo second"]
+	content, err := os.ReadFile(filepath.Join("testdata", "gob.cache"))
+	require.Nil(t, err)
+	path := filepath.Join(t.TempDir(), "cache")
+	require.Nil(t, os.WriteFile(path, content, 0o600))
+
+	c, err := Open(path)
+	require.Nil(t, err)
+	require.Equal(t, "Jane", c.LoadVar("legacy", "name"))
+	// kept until the blocks run again
+	require.Nil(t, c.Store())
+	require.Nil(t, c.Close())
+
+	c, err = Open(path)
+	require.Nil(t, err)
+	defer c.Close()
+	require.False(t, c.MigrateCommands("legacy", []string{"echo install >> /tmp/legacy-count"}))
+	require.False(t, c.MigrateCommands("other", []string{"echo second"}))
+	require.True(t, c.MigrateCommands("legacy", []string{"echo second"}))
+	// only migrated once
+	require.False(t, c.MigrateCommands("legacy", []string{"echo second"}))
+	require.True(t, c.MigrateCommands("legacy", []string{"echo install >> /tmp/legacy-count", "echo done"}))
+
+	require.Nil(t, c.Store())
+	content, err = os.ReadFile(path)
+	require.Nil(t, err)
+	got := cacheJSON{}
+	require.Nil(t, json.Unmarshal(content, &got))
+	require.Equal(t, cacheJSON{
+		Version:   Version,
+		Variables: variablesMap{"legacy": {"name": "Jane"}},
+	}, got)
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name          string
+		content       string
+		wantVariables variablesMap
+		wantErr       bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:          "json",
+			content:       `{"version": 1, "variables": {"vim": {"name": "Jane"}}, "commands": {}}`,
+			wantVariables: variablesMap{"vim": {"name": "Jane"}},
+		},
+		{
+			name:    "newer version",
+			content: `{"version": 2, "variables": {}, "commands": {}}`,
+			wantErr: true,
+		},
+		{
+			name:    "missing version",
+			content: `{"variables": {}, "commands": {}}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid",
+			content: "not a cache",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decode([]byte(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("decode() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			require.Equal(t, tt.wantVariables, got.Variables)
+		})
+	}
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+
+	c, err := Open(path)
+	require.Nil(t, err)
+	c.UpsertVar("vim", "name", "a long value which is removed again")
+	require.Nil(t, c.Store())
+
+	// the shorter cache replaces the previous content
+	require.Nil(t, c.Clean("vim"))
+	require.Nil(t, c.Close())
+
+	c, err = Open(path)
+	require.Nil(t, err)
+	defer c.Close()
+	require.Empty(t, c.LoadVars("vim"))
+
+	// only the cache and the lock file, no temporary files
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.Nil(t, err)
+	require.Len(t, entries, 2)
+}
+
+func TestOpenLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+
+	c, err := Open(path)
+	require.Nil(t, err)
+
+	opened := make(chan *Cache)
+	go func() {
+		other, err := Open(path)
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- other
+	}()
+
+	select {
+	case <-opened:
+		t.Fatal("opened the cache while it was locked")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.Nil(t, c.Close())
+	require.Nil(t, (<-opened).Close())
+}
+
+func TestVars(t *testing.T) {
+	c, err := Open(filepath.Join(t.TempDir(), "cache"))
+	require.Nil(t, err)
+	defer c.Close()
+
+	c.UpsertVar("git", "email", "jane@example.com")
+	c.UpsertVar("git", "token", "abc")
+	c.SetSecret("git", "token", true)
+
+	require.Equal(t, map[string]map[string]string{"git": {"email": "jane@example.com", "token": "abc"}}, c.Vars(false))
+	require.Equal(t, map[string]map[string]string{"git": {"email": "jane@example.com", "token": mask}}, c.Vars(true))
+
+	out := &bytes.Buffer{}
+	c.ListVars(out, true)
+	require.Equal(t, "id: git\n---\nemail: jane@example.com\ntoken: ********\n\n", out.String())
+
+	require.True(t, c.DeleteVar("git", "token"))
+	require.False(t, c.DeleteVar("git", "token"))
+	require.False(t, c.IsSecret("git", "token"))
+}
+
+func TestPrune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	c, err := Open(path)
+	require.Nil(t, err)
+	c.UpsertVar("git", "token", "abc")
+	c.SetSecret("git", "token", true)
+	c.UpsertCommand("git", "hash", "git pull")
+	require.Nil(t, c.Store())
+	require.Nil(t, c.Close())
+
+	require.Nil(t, Prune(path))
+
+	content, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.JSONEq(t, `{"version": 1, "variables": {}}`, string(content))
+}
+
+func TestMasker(t *testing.T) {
+	c, err := Open(filepath.Join(t.TempDir(), "cache"))
+	require.Nil(t, err)
+	defer c.Close()
+
+	c.UpsertVar("git", "email", "jane@example.com")
+	c.UpsertVar("git", "token", "abc")
+	c.UpsertVar("git", "long", "abcdef")
+	c.SetSecret("git", "token", true)
+	c.SetSecret("git", "long", true)
+	c.UpsertCommand("git", "hash", "git config token abcdef")
+
+	require.Equal(t, "jane@example.com ******** ********", c.Masker("git").Replace("jane@example.com abc abcdef"))
+	require.Equal(t, "abc", c.Masker("other").Replace("abc"))
+	require.Equal(t, []string{"git config token ********"}, c.Commands("git"))
+}
+
+func TestExportImport(t *testing.T) {
+	dir := t.TempDir()
+
+	c, err := Open(filepath.Join(dir, "cache"))
+	require.Nil(t, err)
+	defer c.Close()
+	c.UpsertVar("git", "email", "jane@example.com")
+	c.UpsertVar("git", "token", "abc")
+	c.SetSecret("git", "token", true)
+	c.UpsertVar("vim", "theme", "dark")
+	c.UpsertCommand("git", "hash", "git config --global user.email jane@example.com")
+
+	export := &bytes.Buffer{}
+	require.Nil(t, c.Export(export, []string{"git"}))
+
+	other, err := Open(filepath.Join(dir, "other"))
+	require.Nil(t, err)
+	defer other.Close()
+
+	count, err := other.Import(export)
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+	require.Equal(t, map[string]map[string]string{"git": {"email": "jane@example.com", "token": mask}}, other.Vars(true))
+	// the commands have to run on each machine
+	require.Empty(t, other.Commands("git"))
+	require.Equal(t, []string{"git config --global user.email jane@example.com"}, c.Commands("git"))
+}
@@ -1,23 +1,45 @@
 package command
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
-	"reflect"
+	"os/user"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/sj14/confible/internal/become"
 	"github.com/sj14/confible/internal/cache"
 	"github.com/sj14/confible/internal/confible"
+	"github.com/sj14/confible/internal/template"
+	"github.com/sj14/confible/internal/utils"
+	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 )
 
+// Extract returns the commands (without handlers) which run before or after the configs
+// were written. The needs of the later commands on the earlier commands are removed,
+// as those already succeeded.
 func Extract(cmds []confible.Command, runAfterCfgs bool) []confible.Command {
-	var result []confible.Command
+	var result, before []confible.Command
 
 	for _, cmd := range cmds {
+		// handlers are extracted by Triggered
+		if len(cmd.OnChange) != 0 {
+			continue
+		}
+		if !cmd.AfterConfigs {
+			before = append(before, cmd)
+		}
 		// extract all commands which should run after configs were written
 		if runAfterCfgs && cmd.AfterConfigs {
 			result = append(result, cmd)
@@ -28,63 +50,586 @@ func Extract(cmds []confible.Command, runAfterCfgs bool) []confible.Command {
 			result = append(result, cmd)
 		}
 	}
+	if runAfterCfgs {
+		// the commands before the configs already succeeded
+		return withoutNeeds(result, before)
+	}
 	return result
 }
 
-func Exec(id string, commands []confible.Command, useCache bool, cacheFilepath string) (err error) {
+// withoutNeeds removes the needs referencing only the other commands and not
+// one of cmds. Unknown needs are kept, running the commands fails then.
+func withoutNeeds(cmds, others []confible.Command) []confible.Command {
+	names := make(map[string]bool)
+	for _, cmd := range cmds {
+		names[cmd.Name] = true
+	}
+
+	for i, cmd := range cmds {
+		var needs []string
+		for _, need := range cmd.Needs {
+			if names[need] || !slices.ContainsFunc(others, func(other confible.Command) bool { return other.Name == need }) {
+				needs = append(needs, need)
+			}
+		}
+		cmds[i].Needs = needs
+	}
+	return cmds
+}
+
+// Triggered returns the commands with on_change referencing one of the
+// changed configs. The references are either names or target paths.
+func Triggered(cmds []confible.Command, changed []string, usr *user.User) []confible.Command {
+	var result, others []confible.Command
+
+	for _, cmd := range cmds {
+		triggered := false
+		for _, ref := range cmd.OnChange {
+			path, err := utils.AbsFilepath(ref, usr)
+			if slices.Contains(changed, ref) || (err == nil && slices.Contains(changed, path)) {
+				triggered = true
+				break
+			}
+		}
+		if triggered {
+			result = append(result, cmd)
+		} else {
+			others = append(others, cmd)
+		}
+	}
+	// the other commands already ran or don't run this time
+	return withoutNeeds(result, others)
+}
+
+// Options of a command execution.
+type Options struct {
+	// Dir is the working directory, the current one when empty.
+	Dir string
+	// Env contains additional environment variables.
+	Env map[string]string
+	// Shell runs the command, sh -c (cmd /C on Windows) when empty.
+	Shell confible.Shell
+	// User runs the command, the current user when nil.
+	User *user.User
+	// Become runs the command as this user with sudo, the current user when empty.
+	Become string
+	// Timeout kills the command when it runs longer, no timeout when 0.
+	Timeout time.Duration
+	// OkExitCodes are the exit codes of a successful command, only 0 when empty.
+	OkExitCodes []int
+	// Stdin is the input of the command.
+	Stdin string
+	// Interpreter executes the command as script file instead of running it with the
+	// shell. An empty non-nil slice uses the default interpreter sh (cmd /C on Windows).
+	Interpreter []string
+}
+
+// WorkDir returns the working directory. The dir is relative to base and
+// supports '~' of usr. Returns base when dir is empty.
+func WorkDir(base, dir string, usr *user.User) (string, error) {
+	if dir == "" {
+		return base, nil
+	}
+	dir, err := utils.AbsFilepath(dir, usr)
+	if err != nil {
+		return "", err
+	}
+	if filepath.IsAbs(dir) {
+		return dir, nil
+	}
+	return filepath.Join(base, dir), nil
+}
+
+// ExecOptions are the options of Exec which apply to all commands of a confible file.
+type ExecOptions struct {
+	// UseCache skips commands which were executed successfully before
+	// and stores the successful commands in the Cache.
+	UseCache bool
+	Cache    *cache.Cache
+	// Dir is the default working directory, usually the directory of the confible file.
+	Dir string
+	// Jobs is the maximum number of concurrently running blocks.
+	Jobs int
+	// Log is the file where the output of all commands is appended, no file when empty.
+	Log string
+	// Quiet only shows the output of failed commands.
+	Quiet bool
+	// User runs the commands with as_user and expands '~' of dir, creates and log.
+	User *user.User
+	// Data renders the templates of the commands, stdin and the script.
+	Data template.Data
+}
+
+// Exec runs the commands. With UseCache, each command is skipped when it was
+// successfully executed before with the same text, environment, working directory
+// and shell, unless always is set. When the context is done, the running command and
+// the processes it started are killed. The returned ignored errors are the failures
+// of commands with ignore_errors.
+//
+// Blocks with parallel run concurrently, at most Jobs at once. They only wait for the
+// previous blocks without parallel and the blocks they need. Blocks without parallel
+// wait for all previous blocks. Blocks are aborted when a block they wait for failed.
+func Exec(ctx context.Context, id string, commands []confible.Command, execOpts ExecOptions) (ignored []error, err error) {
 	if len(commands) == 0 {
+		return nil, nil
+	}
+
+	c := &commandCache{mask: strings.NewReplacer()}
+	if execOpts.UseCache {
+		c.cache = execOpts.Cache
+	}
+	if execOpts.Cache != nil {
+		c.mask = execOpts.Cache.Masker(id)
+	}
+
+	deps, err := dependencies(commands)
+	if err != nil {
+		return nil, fmt.Errorf("[%v] %v", id, err)
+	}
+
+	jobs := execOpts.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	sem := make(chan struct{}, jobs)
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+		// result of each block, set before the block is done
+		errs    = make([]error, len(commands))
+		aborted = make([]bool, len(commands))
+		done    = make([]chan struct{}, len(commands))
+	)
+	for i := range commands {
+		done[i] = make(chan struct{})
+	}
+
+	for i, block := range commands {
+		wg.Add(1)
+		go func(i int, block confible.Command) {
+			defer wg.Done()
+			defer close(done[i])
+
+			for _, dep := range deps[i] {
+				<-done[dep]
+				if errs[dep] != nil {
+					errs[i] = fmt.Errorf("aborted commands %v as %v failed", blockName(commands, i), blockName(commands, dep))
+					aborted[i] = true
+					return
+				}
+			}
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				aborted[i] = true
+				return
+			}
+
+			var stdout, stderr io.Writer = os.Stdout, os.Stderr
+			var prefix string
+			if block.Parallel {
+				// the output of concurrent blocks is interleaved
+				prefix = fmt.Sprintf("[%v] ", blockName(commands, i))
+				prefixedStdout, prefixedStderr := newPrefixWriter(os.Stdout, prefix), newPrefixWriter(os.Stderr, prefix)
+				defer prefixedStdout.Flush()
+				defer prefixedStderr.Flush()
+				stdout, stderr = prefixedStdout, prefixedStderr
+			}
+
+			blockIgnored, err := execBlock(ctx, id, block, c, execOpts, prefix, stdout, stderr)
+			errs[i] = err
+
+			mu.Lock()
+			ignored = append(ignored, blockIgnored...)
+			mu.Unlock()
+		}(i, block)
+	}
+	wg.Wait()
+
+	var failed []error
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if aborted[i] {
+			log.Printf("[%v] %v\n", id, err)
+			continue
+		}
+		failed = append(failed, err)
+	}
+	if len(failed) == 0 && ctx.Err() != nil {
+		return ignored, ctx.Err()
+	}
+	return ignored, errors.Join(failed...)
+}
+
+// commandCache is the cache shared by the concurrently running blocks.
+type commandCache struct {
+	mu sync.Mutex
+	// nil when the cache is disabled
+	cache *cache.Cache
+	// masks the values of secret variables in the log files and errors
+	mask *strings.Replacer
+}
+
+func (c *commandCache) isExecuted(id, hash string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cache != nil && c.cache.IsExecuted(id, hash)
+}
+
+// migrate marks the exec steps as executed when the block with the exec list was
+// executed by an older confible version, whose cache didn't contain the hashes.
+func (c *commandCache) migrate(id string, exec []string, steps []step) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cache == nil || !c.cache.MigrateCommands(id, exec) {
+		return nil
+	}
+	for _, s := range steps {
+		c.cache.UpsertCommand(id, hash(s.cmd, s.opts), s.text)
+	}
+	return c.cache.Store()
+}
+
+// store marks the command as executed and stores the cache immediately,
+// a later failure shouldn't rerun this command.
+func (c *commandCache) store(id, hash, cmd string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cache == nil {
 		return nil
 	}
+	c.cache.UpsertCommand(id, hash, cmd)
+	return c.cache.Store()
+}
+
+// execBlock runs the commands of a single [[commands]] block. The prefix is
+// written before each output line in the log files.
+func execBlock(ctx context.Context, id string, commands confible.Command, c *commandCache, execOpts ExecOptions, prefix string, stdout, stderr io.Writer) (ignored []error, err error) {
+	usr := execOpts.User
+
+	// check if we can skip those commands
+	if len(commands.OSs) != 0 && !slices.Contains(commands.OSs, runtime.GOOS) {
+		log.Printf("[%v] skipping as operating system %q is not matching commands filter %q\n", id, runtime.GOOS, commands.OSs)
+		return nil, nil
+	}
+	if len(commands.Archs) != 0 && !slices.Contains(commands.Archs, runtime.GOARCH) {
+		log.Printf("[%v] skipping as machine arch %q is not matching commands filter %q\n", id, runtime.GOARCH, commands.Archs)
+		return nil, nil
+	}
+
+	dir, err := WorkDir(execOpts.Dir, commands.Dir, usr)
+	if err != nil {
+		return nil, err
+	}
+	opts := Options{
+		Dir:     dir,
+		Env:     commands.Env,
+		Shell:   commands.Shell,
+		Timeout: time.Duration(commands.Timeout),
+	}
+	if commands.AsUser {
+		opts.User = usr
+	}
+	opts.Become = commands.BecomeUser()
 
-	var cacheInstance *cache.Cache
-	if useCache {
-		cacheInstance, err = cache.New(cacheFilepath)
+	// the conditions are templates like the commands
+	if commands.Creates, err = template.Render("creates", commands.Creates, execOpts.Data); err != nil {
+		return nil, fmt.Errorf("failed rendering creates: %v", err)
+	}
+	if commands.Unless, err = template.Render("unless", commands.Unless, execOpts.Data); err != nil {
+		return nil, fmt.Errorf("failed rendering unless: %v", err)
+	}
+	if commands.OnlyIf, err = template.Render("onlyif", commands.OnlyIf, execOpts.Data); err != nil {
+		return nil, fmt.Errorf("failed rendering onlyif: %v", err)
+	}
+
+	if commands.Stdin != "" {
+		stdin, err := template.Render("stdin", commands.Stdin, execOpts.Data)
 		if err != nil {
-			log.Fatalln(err)
+			return nil, fmt.Errorf("failed rendering stdin: %v", err)
 		}
-		cachedCommands := cacheInstance.LoadCommands(id)
-		if reflect.DeepEqual(cachedCommands, commands) {
-			log.Printf("[%v] commands are cached", id)
-			return nil
+		opts.Stdin = stdin
+	}
+
+	steps := make([]step, 0, len(commands.Exec)+1)
+	for _, text := range commands.Exec {
+		cmd, err := template.Render("exec", text, execOpts.Data)
+		if err != nil {
+			return nil, fmt.Errorf("failed rendering command '%v': %v", text, err)
 		}
+		steps = append(steps, step{cmd: cmd, text: text, opts: opts})
 	}
-	for _, commands := range commands {
-		// check if we can skip those commands
-		if len(commands.OSs) != 0 && !slices.Contains(commands.OSs, runtime.GOOS) {
-			log.Printf("[%v] skipping as operating system %q is not matching commands filter %q\n", id, runtime.GOOS, commands.OSs)
-			continue
+	// the script runs after the commands
+	if commands.Script != "" {
+		script, err := template.Render("script", commands.Script, execOpts.Data)
+		if err != nil {
+			return nil, fmt.Errorf("failed rendering script: %v", err)
+		}
+		scriptOpts := opts
+		scriptOpts.Interpreter = strings.Fields(commands.Interpreter)
+		if scriptOpts.Interpreter == nil {
+			scriptOpts.Interpreter = []string{}
 		}
-		if len(commands.Archs) != 0 && !slices.Contains(commands.Archs, runtime.GOARCH) {
-			log.Printf("[%v] skipping as machine arch %q is not matching commands filter %q\n", id, runtime.GOARCH, commands.Archs)
+		steps = append(steps, step{cmd: script, text: commands.Script, opts: scriptOpts})
+	}
+
+	if !commands.Always {
+		// the script is always after the exec steps
+		if err := c.migrate(id, commands.Exec, steps[:len(commands.Exec)]); err != nil {
+			return nil, err
+		}
+	}
+
+	// the commands which were not executed successfully before
+	var pending []step
+	var pendingCmds []string
+	for _, s := range steps {
+		if !commands.Always && c.isExecuted(id, hash(s.cmd, s.opts)) {
+			log.Printf("[%v] command '%v' is cached\n", id, s.text)
 			continue
 		}
+		pending = append(pending, s)
+		pendingCmds = append(pendingCmds, s.text)
+	}
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	reason, ok, err := skip(ctx, commands, opts, usr)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		log.Printf("[%v] skipping commands %q as %s\n", id, pendingCmds, reason)
+		return nil, nil
+	}
 
-		for _, cmd := range commands.Exec {
-			if err := ExecNoCache(cmd, os.Stdout); err != nil {
-				return err
+	out := output{
+		stdout: stdout,
+		stderr: stderr,
+		quiet:  execOpts.Quiet || commands.Quiet,
+		prefix: prefix,
+		mask:   c.mask,
+	}
+	if execOpts.Log != "" {
+		out.logs = append(out.logs, execOpts.Log)
+	}
+	if commands.Log != "" {
+		// relative to the confible file like dir
+		logPath, err := WorkDir(execOpts.Dir, commands.Log, usr)
+		if err != nil {
+			return nil, err
+		}
+		out.logs = append(out.logs, logPath)
+	}
+
+	for _, s := range pending {
+		// only for the commands, not for the conditions
+		s.opts.OkExitCodes = commands.OkExitCodes
+
+		err := retry(ctx, id, s.cmd, out, s.opts, commands.Retries, time.Duration(commands.RetryDelay))
+		if err != nil {
+			if !commands.IgnoreErrors || ctx.Err() != nil {
+				return ignored, err
 			}
+			// not cached, the command runs again next time
+			log.Printf("[%v] ignoring error: %v\n", id, err)
+			ignored = append(ignored, err)
+			continue
+		}
+
+		if err := c.store(id, hash(s.cmd, s.opts), s.text); err != nil {
+			return ignored, err
 		}
 	}
-	if useCache {
-		cacheInstance.UpsertCommands(id, commands)
-		if err := cacheInstance.Store(cacheFilepath); err != nil {
+	return ignored, nil
+}
+
+// step is a command or the script of a block with its options.
+type step struct {
+	cmd string
+	// the unrendered template for the logs and the cache, which doesn't
+	// contain the values of secret variables
+	text string
+	opts Options
+}
+
+// hash identifies the command with its environment for the cache.
+func hash(cmd string, opts Options) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "cmd: %q\ndir: %q\nshell: %q\n", cmd, opts.Dir, opts.Shell)
+	// keeps the hashes of commands without become, stdin or interpreter
+	if opts.Become != "" {
+		fmt.Fprintf(h, "become: %q\n", opts.Become)
+	}
+	if opts.Stdin != "" {
+		fmt.Fprintf(h, "stdin: %q\n", opts.Stdin)
+	}
+	if opts.Interpreter != nil {
+		fmt.Fprintf(h, "interpreter: %q\n", opts.Interpreter)
+	}
+
+	keys := maps.Keys(opts.Env)
+	slices.Sort(keys)
+	for _, key := range keys {
+		fmt.Fprintf(h, "env: %q=%q\n", key, opts.Env[key])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// retry runs the command until it succeeds, at most retries+1 times.
+func retry(ctx context.Context, id, cmd string, out output, opts Options, retries int, delay time.Duration) error {
+	for attempt := 0; ; attempt++ {
+		err := runLogged(ctx, id, cmd, out, opts)
+		if err == nil || attempt >= retries || ctx.Err() != nil {
 			return err
 		}
+
+		log.Printf("[%v] %v, retrying in %v (%d/%d)\n", id, err, delay, attempt+1, retries)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
-	return nil
 }
 
-func ExecNoCache(cmd string, stdout io.Writer) error {
-	c := exec.Command("sh", "-c", cmd)
+// skip checks the creates, unless and onlyif conditions and returns
+// the reason when the commands should be skipped. The conditions
+// run with the options of the commands, '~' of creates is expanded for usr.
+func skip(ctx context.Context, commands confible.Command, opts Options, usr *user.User) (string, bool, error) {
+	// the input is only for the commands
+	opts.Stdin = ""
 
-	if runtime.GOOS == "windows" {
-		c = exec.Command("cmd", "/C", cmd)
+	if commands.Creates != "" {
+		path, err := WorkDir(opts.Dir, commands.Creates, usr)
+		if err != nil {
+			return "", false, err
+		}
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Sprintf("%q exists", path), true, nil
+		}
+	}
+	if commands.Unless != "" {
+		if err := run(ctx, commands.Unless, io.Discard, io.Discard, opts); err == nil {
+			return fmt.Sprintf("'%v' succeeded", commands.Unless), true, nil
+		}
+	}
+	if commands.OnlyIf != "" {
+		if err := run(ctx, commands.OnlyIf, io.Discard, io.Discard, opts); err != nil {
+			return fmt.Sprintf("'%v' failed", commands.OnlyIf), true, nil
+		}
+	}
+	return "", false, nil
+}
+
+func ExecNoCache(ctx context.Context, cmd string, stdout io.Writer, opts Options) error {
+	return run(ctx, cmd, stdout, os.Stderr, opts)
+}
+
+// run executes the command with the given options.
+func run(ctx context.Context, cmd string, stdout, stderr io.Writer, opts Options) error {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	keys := maps.Keys(opts.Env)
+	slices.Sort(keys)
+	var env []string
+	for _, key := range keys {
+		env = append(env, key+"="+opts.Env[key])
+	}
+
+	name := "command '" + cmd + "'"
+	var args []string
+	if opts.Interpreter != nil {
+		name = "script"
+		path, remove, err := writeScript(ctx, cmd, opts)
+		if err != nil {
+			return fmt.Errorf("failed writing script: %v", err)
+		}
+		defer remove()
+
+		interpreter := opts.Interpreter
+		if len(interpreter) == 0 {
+			interpreter = []string{"sh"}
+			if runtime.GOOS == "windows" {
+				interpreter = []string{"cmd", "/C"}
+			}
+		}
+		args = append(append(args, interpreter...), path)
+	} else {
+		shell := opts.Shell
+		if len(shell) == 0 {
+			shell = confible.Shell{"sh", "-c"}
+			if runtime.GOOS == "windows" {
+				shell = confible.Shell{"cmd", "/C"}
+			}
+		}
+		args = append(append(args, shell...), cmd)
+	}
+
+	if opts.Become != "" {
+		if err := become.Authenticate(ctx); err != nil {
+			return fmt.Errorf("failed running %s: %v", name, err)
+		}
+		// sudo resets the environment, the variables are passed explicitly
+		args = become.Args(opts.Become, env, args...)
+	}
+
+	c := exec.CommandContext(ctx, args[0], args[1:]...)
+	setProcessGroup(c)
+	// don't wait forever for processes which inherited stdout or stderr
+	c.WaitDelay = time.Second
+	c.Dir = opts.Dir
+	c.Env = os.Environ()
+
+	// sudo switches the user itself
+	if opts.User != nil && opts.Become == "" {
+		if err := setCredential(c, opts.User); err != nil {
+			return err
+		}
+		c.Env = append(c.Env, "HOME="+opts.User.HomeDir, "USER="+opts.User.Username, "LOGNAME="+opts.User.Username)
 	}
-	c.Stderr = os.Stderr
+	c.Env = append(c.Env, env...)
+
+	c.Stderr = stderr
 	c.Stdout = stdout
+	if opts.Stdin != "" {
+		c.Stdin = strings.NewReader(opts.Stdin)
+	}
+
+	err := c.Run()
+
+	// only exit codes count as success, not errors like a missing shell
+	var exitErr *exec.ExitError
+	if len(opts.OkExitCodes) != 0 && (err == nil || errors.As(err, &exitErr)) {
+		code := 0
+		if exitErr != nil {
+			code = exitErr.ExitCode()
+		}
+		if slices.Contains(opts.OkExitCodes, code) {
+			return nil
+		}
+		err = fmt.Errorf("exit status %d is not one of the ok exit codes %v", code, opts.OkExitCodes)
+	}
 
-	if err := c.Run(); err != nil {
-		return fmt.Errorf("failed running command '%v': %v", cmd, err)
+	if err != nil {
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			return fmt.Errorf("failed running %s: timed out after %v", name, opts.Timeout)
+		case ctx.Err() != nil:
+			return fmt.Errorf("failed running %s: %w", name, ctx.Err())
+		}
+		return fmt.Errorf("failed running %s: %v", name, err)
 	}
 	return nil
 }
@@ -2,11 +2,18 @@ package command
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/sj14/confible/internal/cache"
 	"github.com/sj14/confible/internal/confible"
+	"github.com/sj14/confible/internal/template"
 	"github.com/stretchr/testify/require"
 )
 
@@ -14,6 +21,7 @@ func TestExecNoCache(t *testing.T) {
 	tests := []struct {
 		name       string
 		cmd        string
+		opts       Options
 		wantStdout string
 		wantErr    bool
 	}{
@@ -22,11 +30,58 @@ func TestExecNoCache(t *testing.T) {
 			cmd:        "echo 'Hello World'",
 			wantStdout: "Hello World\n",
 		},
+		{
+			name:       "dir",
+			cmd:        "ls command_test.go",
+			opts:       Options{Dir: filepath.Join("..", "command")},
+			wantStdout: "command_test.go\n",
+		},
+		{
+			name:       "env",
+			cmd:        "echo $GREETING",
+			opts:       Options{Env: map[string]string{"GREETING": "Hello World"}},
+			wantStdout: "Hello World\n",
+		},
+		{
+			name:       "shell",
+			cmd:        "echo $0",
+			opts:       Options{Shell: confible.Shell{"sh", "-c"}},
+			wantStdout: "sh\n",
+		},
+		{
+			name:    "failing",
+			cmd:     "exit 1",
+			wantErr: true,
+		},
+		{
+			name:       "stdin",
+			cmd:        "cat",
+			opts:       Options{Stdin: "Hello World\n"},
+			wantStdout: "Hello World\n",
+		},
+		{
+			name:       "script",
+			cmd:        "greeting='Hello World'\necho \"$greeting\"\n",
+			opts:       Options{Interpreter: []string{}},
+			wantStdout: "Hello World\n",
+		},
+		{
+			name:    "script interpreter",
+			cmd:     "false\necho 'not reached'\n",
+			opts:    Options{Interpreter: []string{"sh", "-e"}},
+			wantErr: true,
+		},
+		{
+			name:    "timeout",
+			cmd:     "sleep 10 & sleep 10",
+			opts:    Options{Timeout: 100 * time.Millisecond},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			stdout := &bytes.Buffer{}
-			if err := ExecNoCache(tt.cmd, stdout); (err != nil) != tt.wantErr {
+			if err := ExecNoCache(context.Background(), tt.cmd, stdout, tt.opts); (err != nil) != tt.wantErr {
 				t.Errorf("ExecNoCache() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
@@ -43,12 +98,14 @@ func TestExec(t *testing.T) {
 		commands  []confible.Command
 		useCache  bool
 		cachePath string
+		data      template.Data
 	}
 	tests := []struct {
-		name     string
-		args     args
-		wantErr  bool
-		teardown func()
+		name        string
+		args        args
+		wantErr     bool
+		wantIgnored int
+		teardown    func()
 	}{
 		{
 			name: "happy no cache",
@@ -64,9 +121,76 @@ func TestExec(t *testing.T) {
 				id:        "happy with cache",
 				commands:  []confible.Command{{Exec: []string{"echo 'Hello World'"}}},
 				useCache:  true,
-				cachePath: ".testcache",
+				cachePath: filepath.Join(t.TempDir(), "cache"),
 			},
-			teardown: func() { require.Nil(t, os.Remove(".testcache")) },
+		},
+		{
+			name: "templated conditions",
+			args: args{
+				id: "templated conditions",
+				commands: []confible.Command{
+					{Unless: "test {{ .Var.skip }} = yes", Exec: []string{"exit 1"}},
+					{OnlyIf: "test {{ .Var.skip }} = no", Exec: []string{"exit 1"}},
+					{Creates: "{{ .Var.file }}", Exec: []string{"exit 1"}},
+				},
+				data: template.Data{Var: map[string]string{"skip": "yes", "file": "command_test.go"}},
+			},
+		},
+		{
+			name: "failing",
+			args: args{
+				id:       "failing",
+				commands: []confible.Command{{Exec: []string{"exit 1", "echo 'not reached'"}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ignore errors",
+			args: args{
+				id:       "ignore errors",
+				commands: []confible.Command{{Exec: []string{"exit 1", "echo 'Hello World'", "exit 2"}, IgnoreErrors: true}},
+			},
+			wantIgnored: 2,
+		},
+		{
+			name: "ok exit codes",
+			args: args{
+				id:       "ok exit codes",
+				commands: []confible.Command{{Exec: []string{"exit 0", "exit 2"}, OkExitCodes: []int{0, 2}}},
+			},
+		},
+		{
+			name: "not ok exit code",
+			args: args{
+				id:       "not ok exit code",
+				commands: []confible.Command{{Exec: []string{"exit 0"}, OkExitCodes: []int{2}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "stdin template",
+			args: args{
+				id:       "stdin template",
+				commands: []confible.Command{{Stdin: "{{ .Var.name }}", Exec: []string{"grep -qx World"}, Script: "grep -qx World"}},
+				data:     template.NewData(map[string]string{"name": "World"}, nil),
+			},
+		},
+		{
+			name: "exec template",
+			args: args{
+				id:       "exec template",
+				commands: []confible.Command{{Exec: []string{"test {{ .Var.name | shellquote }} = \"it's me\""}}},
+				data:     template.NewData(map[string]string{"name": "it's me"}, nil),
+			},
+		},
+		{
+			name: "retries",
+			args: args{
+				id: "retries",
+				// fails on the first attempt only
+				commands: []confible.Command{{Exec: []string{"test -f .testretry || { touch .testretry; exit 1; }"}, Retries: 1}},
+			},
+			teardown: func() { require.Nil(t, os.Remove(".testretry")) },
 		},
 	}
 	for _, tt := range tests {
@@ -76,9 +200,18 @@ func TestExec(t *testing.T) {
 					tt.teardown()
 				}
 			}()
-			if err := Exec(tt.args.id, tt.args.commands, tt.args.useCache, tt.args.cachePath); (err != nil) != tt.wantErr {
+			execOpts := ExecOptions{UseCache: tt.args.useCache, Data: tt.args.data}
+			if tt.args.cachePath != "" {
+				c, err := cache.Open(tt.args.cachePath)
+				require.Nil(t, err)
+				defer c.Close()
+				execOpts.Cache = c
+			}
+			ignored, err := Exec(context.Background(), tt.args.id, tt.args.commands, execOpts)
+			if (err != nil) != tt.wantErr {
 				t.Errorf("Exec() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			require.Len(t, ignored, tt.wantIgnored)
 		})
 	}
 }
@@ -157,6 +290,47 @@ func TestExtract(t *testing.T) {
 				{AfterConfigs: true, Exec: []string{"after2"}},
 			},
 		},
+		{
+			name: "without handlers",
+			args: args{
+				runAfterCfgs: true,
+				cmds: []confible.Command{
+					{AfterConfigs: true, Exec: []string{"after1"}},
+					{AfterConfigs: true, OnChange: []string{"config"}, Exec: []string{"handler"}},
+				},
+			},
+			want: []confible.Command{
+				{AfterConfigs: true, Exec: []string{"after1"}},
+			},
+		},
+		{
+			name: "before/needs after",
+			args: args{
+				runAfterCfgs: false,
+				cmds: []confible.Command{
+					{Name: "before", Needs: []string{"after"}},
+					{Name: "after", AfterConfigs: true},
+				},
+			},
+			want: []confible.Command{
+				{Name: "before", Needs: []string{"after"}},
+			},
+		},
+		{
+			name: "after/needs before",
+			args: args{
+				runAfterCfgs: true,
+				cmds: []confible.Command{
+					{Name: "before"},
+					{Name: "after1", AfterConfigs: true},
+					{Name: "after2", AfterConfigs: true, Needs: []string{"before", "after1", "unknown"}},
+				},
+			},
+			want: []confible.Command{
+				{Name: "after1", AfterConfigs: true},
+				{Name: "after2", AfterConfigs: true, Needs: []string{"after1", "unknown"}},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -166,3 +340,200 @@ func TestExtract(t *testing.T) {
 		})
 	}
 }
+
+func TestSkip(t *testing.T) {
+	tests := []struct {
+		name     string
+		commands confible.Command
+		wantSkip bool
+	}{
+		{
+			name: "no conditions",
+		},
+		{
+			name:     "creates exists",
+			commands: confible.Command{Creates: "command_test.go"},
+			wantSkip: true,
+		},
+		{
+			name:     "creates missing",
+			commands: confible.Command{Creates: "missing"},
+		},
+		{
+			name:     "unless succeeds",
+			commands: confible.Command{Unless: "true"},
+			wantSkip: true,
+		},
+		{
+			name:     "unless fails",
+			commands: confible.Command{Unless: "false"},
+		},
+		{
+			name:     "onlyif succeeds",
+			commands: confible.Command{OnlyIf: "true"},
+		},
+		{
+			name:     "onlyif fails",
+			commands: confible.Command{OnlyIf: "false"},
+			wantSkip: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, gotSkip, err := skip(context.Background(), tt.commands, Options{}, nil)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantSkip, gotSkip)
+		})
+	}
+}
+
+func TestWorkDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    string
+		dir     string
+		want    string
+		wantErr bool
+	}{
+		{name: "empty", base: "/base", want: "/base"},
+		{name: "relative", base: "/base", dir: "sub", want: filepath.Join("/base", "sub")},
+		{name: "absolute", base: "/base", dir: "/other", want: "/other"},
+		{name: "unknown user", base: "/base", dir: "~unknown-confible-user/sub", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := WorkDir(tt.base, tt.dir, nil)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestTriggered(t *testing.T) {
+	cmds := []confible.Command{
+		{Exec: []string{"always"}},
+		{OnChange: []string{"tmux-config"}, Exec: []string{"by name"}},
+		{OnChange: []string{"/tmp/.tmux.conf"}, Exec: []string{"by path"}},
+		{OnChange: []string{"other", "tmux-config"}, Exec: []string{"multiple"}},
+	}
+
+	tests := []struct {
+		name    string
+		changed []string
+		want    []confible.Command
+	}{
+		{
+			name: "nothing changed",
+		},
+		{
+			name:    "changed",
+			changed: []string{"/tmp/.tmux.conf", "tmux-config"},
+			want:    cmds[1:],
+		},
+		{
+			name:    "other changed",
+			changed: []string{"/tmp/.zshrc", "other"},
+			want:    cmds[3:],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, Triggered(cmds, tt.changed, nil))
+		})
+	}
+}
+
+func TestTriggeredNeeds(t *testing.T) {
+	cmds := []confible.Command{
+		{Name: "install"},
+		{Name: "reload", OnChange: []string{"config"}, Needs: []string{"install", "restart", "unknown"}},
+		{Name: "restart", OnChange: []string{"other"}},
+	}
+	want := []confible.Command{
+		{Name: "reload", OnChange: []string{"config"}, Needs: []string{"unknown"}},
+	}
+	require.Equal(t, want, Triggered(cmds, []string{"config"}, nil))
+	// not modified
+	require.Equal(t, []string{"install", "restart", "unknown"}, cmds[1].Needs)
+}
+
+func TestExecCache(t *testing.T) {
+	c, err := cache.Open(filepath.Join(t.TempDir(), "cache"))
+	require.Nil(t, err)
+	defer c.Close()
+	countPath := filepath.Join(t.TempDir(), "count")
+
+	count := func() int {
+		content, err := os.ReadFile(countPath)
+		if errors.Is(err, os.ErrNotExist) {
+			return 0
+		}
+		require.Nil(t, err)
+		return strings.Count(string(content), "\n")
+	}
+
+	exec := func(commands ...confible.Command) error {
+		_, err := Exec(context.Background(), "cache", commands, ExecOptions{UseCache: true, Cache: c})
+		return err
+	}
+
+	cached := confible.Command{Exec: []string{"echo cached >> " + countPath}}
+	always := confible.Command{Exec: []string{"echo always >> " + countPath}, Always: true}
+	failing := confible.Command{Exec: []string{"echo failing >> " + countPath, "exit 1"}}
+
+	require.Nil(t, exec(cached, always))
+	require.Equal(t, 2, count())
+
+	// only the command with always runs again
+	require.Nil(t, exec(cached, always))
+	require.Equal(t, 3, count())
+
+	// a changed environment runs the command again
+	cached.Env = map[string]string{"FOO": "bar"}
+	require.Nil(t, exec(cached))
+	require.Equal(t, 4, count())
+
+	// the successful command before the failing one is cached
+	require.Error(t, exec(failing))
+	require.Equal(t, 5, count())
+	require.Error(t, exec(failing))
+	require.Equal(t, 5, count())
+}
+
+func TestExecSecrets(t *testing.T) {
+	dir := t.TempDir()
+	c, err := cache.Open(filepath.Join(dir, "cache"))
+	require.Nil(t, err)
+	defer c.Close()
+
+	c.UpsertVar("secrets", "token", "abc123")
+	c.SetSecret("secrets", "token", true)
+
+	logPath := filepath.Join(dir, "log")
+	commands := []confible.Command{{Exec: []string{"echo {{ .Var.token }}"}, Quiet: true}}
+	execOpts := ExecOptions{
+		UseCache: true,
+		Cache:    c,
+		Log:      logPath,
+		Data:     template.Data{Var: c.LoadVars("secrets")},
+	}
+	_, err = Exec(context.Background(), "secrets", commands, execOpts)
+	require.Nil(t, err)
+
+	// the template is cached instead of the rendered command
+	require.Equal(t, []string{"echo {{ .Var.token }}"}, c.Commands("secrets"))
+
+	content, err := os.ReadFile(logPath)
+	require.Nil(t, err)
+	require.NotContains(t, string(content), "abc123")
+	require.Contains(t, string(content), "$ echo ********\n********\n")
+
+	// the error contains the command
+	commands = []confible.Command{{Exec: []string{"echo {{ .Var.token }}; exit 3"}, Quiet: true}}
+	_, err = Exec(context.Background(), "secrets", commands, execOpts)
+	require.EqualError(t, err, "failed running command 'echo ********; exit 3': exit status 3")
+}
@@ -0,0 +1,28 @@
+//go:build !windows
+
+package command
+
+import (
+	"fmt"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+func setCredential(c *exec.Cmd, usr *user.User) error {
+	uid, err := strconv.ParseUint(usr.Uid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid uid %q of user %q: %v", usr.Uid, usr.Username, err)
+	}
+	gid, err := strconv.ParseUint(usr.Gid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid gid %q of user %q: %v", usr.Gid, usr.Username, err)
+	}
+
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build windows
+
+package command
+
+import (
+	"fmt"
+	"os/exec"
+	"os/user"
+)
+
+func setCredential(c *exec.Cmd, usr *user.User) error {
+	return fmt.Errorf("running commands as user %q is not supported on windows", usr.Username)
+}
@@ -0,0 +1,129 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// output of the commands of a block
+type output struct {
+	stdout io.Writer
+	stderr io.Writer
+	// files where the output is appended
+	logs []string
+	// only write the output to stdout and stderr when the command failed
+	quiet bool
+	// written before each output line in the log files, as parallel blocks
+	// write to the same file
+	prefix string
+	// masks the values of secret variables in the log files and errors, when not nil
+	mask *strings.Replacer
+}
+
+// runLogged runs the command and writes its output to stdout, stderr and the log files.
+// Each log entry contains the command, the output, the exit status and the duration.
+func runLogged(ctx context.Context, id, cmd string, out output, opts Options) error {
+	stdout, stderr := out.stdout, out.stderr
+
+	// keeps the order of stdout and stderr for showing it on failure
+	quietOutput := &syncBuffer{}
+	if out.quiet {
+		stdout, stderr = quietOutput, quietOutput
+	}
+
+	var (
+		logFiles   []*os.File
+		logWriters []*prefixWriter
+	)
+	for _, path := range out.logs {
+		logFile, err := openLog(path)
+		if err != nil {
+			return err
+		}
+		defer logFile.Close()
+		logFiles = append(logFiles, logFile)
+
+		logCmd := cmd
+		if out.mask != nil {
+			logCmd = out.mask.Replace(cmd)
+		}
+		fmt.Fprintf(logFile, "=== %s [%v] $ %s\n", time.Now().Format(time.RFC3339), id, logCmd)
+
+		// separate writers as stdout and stderr are written concurrently
+		logStdout, logStderr := newPrefixWriter(logFile, out.prefix), newPrefixWriter(logFile, out.prefix)
+		logStdout.mask, logStderr.mask = out.mask, out.mask
+		logWriters = append(logWriters, logStdout, logStderr)
+		stdout = io.MultiWriter(stdout, logStdout)
+		stderr = io.MultiWriter(stderr, logStderr)
+	}
+
+	start := time.Now()
+	err := run(ctx, cmd, stdout, stderr, opts)
+	duration := time.Since(start).Round(time.Millisecond)
+	if err != nil && out.mask != nil {
+		// the error contains the command
+		err = maskedError{msg: out.mask.Replace(err.Error()), err: err}
+	}
+
+	status := "exit status 0"
+	if err != nil {
+		status = err.Error()
+	}
+	for _, w := range logWriters {
+		w.Flush()
+	}
+	for _, logFile := range logFiles {
+		fmt.Fprintf(logFile, "=== %s [%v] %s after %v\n\n", time.Now().Format(time.RFC3339), id, status, duration)
+	}
+
+	if err != nil && out.quiet {
+		io.Copy(out.stderr, quietOutput)
+	}
+	return err
+}
+
+// maskedError is an error with the values of secret variables masked in its message.
+type maskedError struct {
+	msg string
+	err error
+}
+
+func (e maskedError) Error() string { return e.msg }
+func (e maskedError) Unwrap() error { return e.err }
+
+// openLog opens the log file for appending and creates its directory.
+func openLog(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed creating log directory: %v", err)
+	}
+	logFile, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening log file: %v", err)
+	}
+	return logFile, nil
+}
+
+// syncBuffer is a bytes.Buffer which can be written concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Read(p)
+}
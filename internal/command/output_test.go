@@ -0,0 +1,71 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunLogged(t *testing.T) {
+	tests := []struct {
+		name       string
+		cmd        string
+		quiet      bool
+		prefix     string
+		wantStdout string
+		wantStderr string
+		wantLog    string
+		wantErr    bool
+	}{
+		{
+			name:       "success",
+			cmd:        "echo out; echo err >&2",
+			wantStdout: "out\n",
+			wantStderr: "err\n",
+			wantLog:    `^=== \S+ \[test\] \$ echo out; echo err >&2\n(out\nerr\n|err\nout\n)=== \S+ \[test\] exit status 0 after \S+\n\n$`,
+		},
+		{
+			name:    "quiet success",
+			cmd:     "echo out",
+			quiet:   true,
+			wantLog: `^=== \S+ \[test\] \$ echo out\nout\n=== \S+ \[test\] exit status 0 after \S+\n\n$`,
+		},
+		{
+			name:       "prefix",
+			cmd:        "echo out",
+			prefix:     "[go] ",
+			wantStdout: "out\n",
+			wantLog:    `^=== \S+ \[test\] \$ echo out\n\[go\] out\n=== \S+ \[test\] exit status 0 after \S+\n\n$`,
+		},
+		{
+			name:       "quiet failure",
+			cmd:        "echo out; exit 3",
+			quiet:      true,
+			wantStderr: "out\n",
+			wantLog:    `^=== \S+ \[test\] \$ echo out; exit 3\nout\n=== \S+ \[test\] failed running command 'echo out; exit 3': exit status 3 after \S+\n\n$`,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logPath := filepath.Join(t.TempDir(), "logs", "test.log")
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+
+			out := output{stdout: stdout, stderr: stderr, logs: []string{logPath}, quiet: tt.quiet, prefix: tt.prefix}
+			err := runLogged(context.Background(), "test", tt.cmd, out, Options{})
+			require.Equal(t, tt.wantErr, err != nil)
+
+			require.Equal(t, tt.wantStdout, stdout.String())
+			require.Equal(t, tt.wantStderr, stderr.String())
+
+			content, err := os.ReadFile(logPath)
+			require.Nil(t, err)
+			require.Regexp(t, regexp.MustCompile(tt.wantLog), string(content))
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sj14/confible/internal/confible"
+	"github.com/sj14/confible/internal/graph"
+)
+
+// blockName returns the name of the block or its position when it has no name.
+func blockName(commands []confible.Command, i int) string {
+	if commands[i].Name != "" {
+		return commands[i].Name
+	}
+	return fmt.Sprintf("#%d", i+1)
+}
+
+// dependencies returns the indexes of the blocks each block waits for. Blocks
+// without parallel wait for all previous blocks and following blocks wait for them.
+// Needs which are not part of the commands are an error, like cycles.
+func dependencies(commands []confible.Command) (map[int][]int, error) {
+	// key == name; value == indexes of the blocks with this name
+	names := make(map[string][]int)
+	for i, block := range commands {
+		if block.Name != "" {
+			names[block.Name] = append(names[block.Name], i)
+		}
+	}
+
+	deps := make(map[int][]int)
+	lastSerial := -1
+	// the parallel blocks since the last block without parallel
+	var parallel []int
+
+	for i, block := range commands {
+		var blockDeps []int
+		if lastSerial != -1 {
+			blockDeps = append(blockDeps, lastSerial)
+		}
+		if block.Parallel {
+			parallel = append(parallel, i)
+		} else {
+			blockDeps = append(blockDeps, parallel...)
+			lastSerial = i
+			parallel = nil
+		}
+		for _, need := range block.Needs {
+			if len(names[need]) == 0 {
+				return nil, fmt.Errorf("commands %q need %q, which is unknown or runs later (e.g. after the configs)", blockName(commands, i), need)
+			}
+			blockDeps = append(blockDeps, names[need]...)
+		}
+		if len(blockDeps) != 0 {
+			deps[i] = blockDeps
+		}
+	}
+
+	// check for cycles, which would block forever
+	var nodes []string
+	graphDeps := make(map[string][]string)
+	for i := range commands {
+		nodes = append(nodes, strconv.Itoa(i))
+		for _, dep := range deps[i] {
+			graphDeps[nodes[i]] = append(graphDeps[nodes[i]], strconv.Itoa(dep))
+		}
+	}
+	if _, err := graph.Sort(nodes, graphDeps); err != nil {
+		var cycle []string
+		for _, node := range err.(*graph.CycleError).Cycle {
+			i, _ := strconv.Atoi(node)
+			cycle = append(cycle, blockName(commands, i))
+		}
+		return nil, &graph.CycleError{Cycle: cycle}
+	}
+	return deps, nil
+}
+
+// outputMu prevents interleaving lines of concurrent blocks.
+var outputMu sync.Mutex
+
+// prefixWriter writes each line with a prefix.
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+	// masks the values of secret variables, when not nil
+	mask *strings.Replacer
+	// incomplete line
+	buf []byte
+}
+
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{w: w, prefix: prefix}
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i == -1 {
+			return len(b), nil
+		}
+		if err := p.writeLine(p.buf[:i+1]); err != nil {
+			return len(b), err
+		}
+		p.buf = p.buf[i+1:]
+	}
+}
+
+// Flush writes the incomplete line.
+func (p *prefixWriter) Flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	line := append(p.buf, '\n')
+	p.buf = nil
+	return p.writeLine(line)
+}
+
+func (p *prefixWriter) writeLine(line []byte) error {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	text := string(line)
+	if p.mask != nil {
+		text = p.mask.Replace(text)
+	}
+	_, err := io.WriteString(p.w, p.prefix+text)
+	return err
+}
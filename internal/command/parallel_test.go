@@ -0,0 +1,104 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/sj14/confible/internal/confible"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDependencies(t *testing.T) {
+	tests := []struct {
+		name     string
+		commands []confible.Command
+		want     map[int][]int
+		wantErr  string
+	}{
+		{
+			name:     "serial",
+			commands: []confible.Command{{}, {}, {}},
+			want:     map[int][]int{1: {0}, 2: {1}},
+		},
+		{
+			name: "parallel",
+			commands: []confible.Command{
+				{},
+				{Parallel: true},
+				{Parallel: true},
+				{},
+			},
+			want: map[int][]int{1: {0}, 2: {0}, 3: {0, 1, 2}},
+		},
+		{
+			name: "needs",
+			commands: []confible.Command{
+				{Name: "brew", Parallel: true},
+				{Name: "go", Parallel: true, Needs: []string{"brew"}},
+				{Name: "gopls", Parallel: true, Needs: []string{"go"}},
+			},
+			want: map[int][]int{1: {0}, 2: {1}},
+		},
+		{
+			name: "unknown needs",
+			commands: []confible.Command{
+				{Name: "go", Parallel: true},
+				{Parallel: true, Needs: []string{"go", "unknown"}},
+			},
+			wantErr: `commands "#2" need "unknown", which is unknown or runs later (e.g. after the configs)`,
+		},
+		{
+			name: "cycle",
+			commands: []confible.Command{
+				{Name: "a", Parallel: true, Needs: []string{"b"}},
+				{Name: "b", Parallel: true, Needs: []string{"a"}},
+			},
+			wantErr: "dependency cycle: a -> b -> a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := dependencies(tt.commands)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.Nil(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestExecParallel(t *testing.T) {
+	dir := t.TempDir()
+
+	commands := []confible.Command{
+		// waits until the second block created the file
+		{Name: "first", Parallel: true, Exec: []string{"while [ ! -f second ]; do sleep 0.01; done"}, Timeout: confible.Duration(5e9)},
+		{Name: "second", Parallel: true, Exec: []string{"touch second"}},
+		{Name: "failing", Parallel: true, Exec: []string{"exit 1"}},
+		{Name: "dependent", Parallel: true, Needs: []string{"failing"}, Exec: []string{"touch dependent"}},
+		{Name: "independent", Parallel: true, Exec: []string{"touch independent"}},
+	}
+
+	_, err := Exec(context.Background(), "parallel", commands, ExecOptions{Dir: dir, Jobs: 2})
+	require.EqualError(t, err, "failed running command 'exit 1': exit status 1")
+
+	require.NoFileExists(t, filepath.Join(dir, "dependent"))
+	require.FileExists(t, filepath.Join(dir, "independent"))
+}
+
+func TestPrefixWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := newPrefixWriter(buf, "[name] ")
+
+	_, err := w.Write([]byte("first\nsec"))
+	require.Nil(t, err)
+	_, err = w.Write([]byte("ond\nincomplete"))
+	require.Nil(t, err)
+	require.Nil(t, w.Flush())
+
+	require.Equal(t, "[name] first\n[name] second\n[name] incomplete\n", buf.String())
+}
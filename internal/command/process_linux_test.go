@@ -0,0 +1,85 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestTerminalRead runs a command reading the terminal in a process which has a pseudo
+// terminal as controlling terminal. The command must not be stopped by SIGTTIN.
+func TestTerminalRead(t *testing.T) {
+	if os.Getenv("CONFIBLE_TEST_TERMINAL") == "1" {
+		err := run(context.Background(), "read x < /dev/tty; echo got=$x", os.Stdout, os.Stderr, Options{Timeout: 5 * time.Second})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	master, slave := openPty(t)
+	defer master.Close()
+
+	c := exec.Command(os.Args[0], "-test.run=^TestTerminalRead$")
+	c.Env = append(os.Environ(), "CONFIBLE_TEST_TERMINAL=1")
+	c.Stdin, c.Stdout, c.Stderr = slave, slave, slave
+	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	require.Nil(t, c.Start())
+	slave.Close()
+
+	_, err := master.Write([]byte("hello\n"))
+	require.Nil(t, err)
+
+	// the output contains the echoed input as well
+	output := make(chan string)
+	go func() {
+		var out []byte
+		buf := make([]byte, 1024)
+		for {
+			n, err := master.Read(buf)
+			out = append(out, buf[:n]...)
+			if err != nil || strings.Contains(string(out), "got=hello") {
+				output <- string(out)
+				return
+			}
+		}
+	}()
+
+	select {
+	case out := <-output:
+		require.Contains(t, out, "got=hello")
+	case <-time.After(10 * time.Second):
+		t.Fatal("the command reading the terminal didn't finish")
+	}
+	require.Nil(t, c.Wait())
+}
+
+// openPty opens a new pseudo terminal and returns its master and slave.
+func openPty(t *testing.T) (*os.File, *os.File) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	require.Nil(t, err)
+
+	unlock := 0
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		t.Fatalf("failed unlocking pty: %v", errno)
+	}
+	var n uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); errno != 0 {
+		t.Fatalf("failed getting pty number: %v", errno)
+	}
+
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("pseudo terminals are not available: %v", err)
+	}
+	return master, slave
+}
@@ -0,0 +1,80 @@
+//go:build !windows
+
+package command
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// hasTerminal reports if confible has a controlling terminal.
+var hasTerminal = sync.OnceValue(func() bool {
+	f, err := os.Open("/dev/tty")
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+})
+
+// setProcessGroup makes sure the processes started by the shell are killed
+// together with the command when the context is done. Otherwise, they would
+// keep running.
+//
+// Without a terminal, the command runs in its own process group, which is killed
+// as a whole. With a terminal, the command stays in the foreground process group,
+// as commands in other groups stop when they read from the terminal (e.g. the
+// password prompts of sudo or ssh). The process tree of the command is killed then.
+func setProcessGroup(c *exec.Cmd) {
+	if hasTerminal() {
+		c.Cancel = func() error {
+			return killTree(c.Process.Pid)
+		}
+		return
+	}
+
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c.SysProcAttr.Setpgid = true
+	c.Cancel = func() error {
+		return syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// killTree kills the process and all its descendants.
+func killTree(pid int) error {
+	pids := []int{pid}
+
+	out, err := exec.Command("ps", "-A", "-o", "pid=", "-o", "ppid=").Output()
+	if err == nil {
+		// key == parent pid
+		children := make(map[int][]int)
+		for _, line := range bytes.Split(out, []byte("\n")) {
+			fields := strings.Fields(string(line))
+			if len(fields) != 2 {
+				continue
+			}
+			child, err1 := strconv.Atoi(fields[0])
+			parent, err2 := strconv.Atoi(fields[1])
+			if err1 == nil && err2 == nil {
+				children[parent] = append(children[parent], child)
+			}
+		}
+		for i := 0; i < len(pids); i++ {
+			pids = append(pids, children[pids[i]]...)
+		}
+	}
+
+	// the command itself is killed even when the descendants can't be listed
+	killErr := syscall.Kill(pid, syscall.SIGKILL)
+	for _, p := range pids[1:] {
+		syscall.Kill(p, syscall.SIGKILL)
+	}
+	return killErr
+}
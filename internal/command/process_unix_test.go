@@ -0,0 +1,50 @@
+//go:build !windows
+
+package command
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKillWithTerminal(t *testing.T) {
+	for _, terminal := range []bool{false, true} {
+		t.Run("terminal "+strconv.FormatBool(terminal), func(t *testing.T) {
+			defer func(f func() bool) { hasTerminal = f }(hasTerminal)
+			hasTerminal = func() bool { return terminal }
+
+			pidPath := filepath.Join(t.TempDir(), "pid")
+			err := run(context.Background(), "sleep 10 & echo $! > "+pidPath+"; wait", io.Discard, io.Discard, Options{Timeout: 200 * time.Millisecond})
+			require.Error(t, err)
+
+			content, err := os.ReadFile(pidPath)
+			require.Nil(t, err)
+			pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+			require.Nil(t, err)
+
+			// the started process was killed together with the shell
+			require.Eventually(t, func() bool {
+				return !running(pid)
+			}, time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+// running returns if the process exists and is not a zombie.
+func running(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return false
+	}
+	out, err := exec.Command("ps", "-o", "stat=", "-p", strconv.Itoa(pid)).Output()
+	return err == nil && !strings.HasPrefix(strings.TrimSpace(string(out)), "Z")
+}
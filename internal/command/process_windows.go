@@ -0,0 +1,10 @@
+//go:build windows
+
+package command
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup is a no-op on windows, only the started process is killed.
+func setProcessGroup(c *exec.Cmd) {}
@@ -0,0 +1,64 @@
+package command
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/sj14/confible/internal/become"
+	"github.com/sj14/confible/internal/utils"
+)
+
+// writeScript writes the script to a temporary file which is only readable by the user
+// running it and returns the path and a function for removing the file after the script ran.
+func writeScript(ctx context.Context, script string, opts Options) (string, func(), error) {
+	// root can read the file of the current user
+	if opts.Become != "" && opts.Become != "root" {
+		return writeBecomeScript(ctx, script, opts.Become)
+	}
+
+	// cmd only runs batch files
+	pattern := "confible-*"
+	if len(opts.Interpreter) == 0 && runtime.GOOS == "windows" {
+		pattern += ".bat"
+	}
+
+	// created with 0600
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", nil, err
+	}
+	remove := func() { os.Remove(f.Name()) }
+
+	if _, err := f.WriteString(script); err != nil {
+		f.Close()
+		remove()
+		return "", nil, err
+	}
+	if err := f.Close(); err != nil {
+		remove()
+		return "", nil, err
+	}
+
+	if opts.Become == "" && opts.User != nil {
+		if err := utils.Chown(f.Name(), opts.User); err != nil {
+			remove()
+			return "", nil, err
+		}
+	}
+	return f.Name(), remove, nil
+}
+
+// writeBecomeScript writes the script as the become user, so the file is owned by it
+// and not readable by other users.
+func writeBecomeScript(ctx context.Context, script, user string) (string, func(), error) {
+	out, err := become.Run(ctx, user, strings.NewReader(script), "sh", "-c", `umask 077 && f=$(mktemp "${TMPDIR:-/tmp}/confible-XXXXXX") && cat > "$f" && echo "$f"`)
+	if err != nil {
+		return "", nil, err
+	}
+	path := strings.TrimSpace(string(out))
+	// also removed when confible was interrupted
+	remove := func() { become.Run(context.WithoutCancel(ctx), user, nil, "rm", "-f", "--", path) }
+	return path, remove, nil
+}
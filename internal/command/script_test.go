@@ -0,0 +1,45 @@
+//go:build !windows
+
+package command
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteScript(t *testing.T) {
+	// runs the arguments after '--' as the current user
+	bin := t.TempDir()
+	sudo := "#!/bin/sh\nwhile [ \"$#\" -gt 0 ] && [ \"$1\" != -- ]; do shift; done\n[ \"$#\" -eq 0 ] && exit 0\nshift\nexec \"$@\"\n"
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "sudo"), []byte(sudo), 0o755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	tests := []struct {
+		name   string
+		become string
+	}{
+		{name: "current user"},
+		{name: "root", become: "root"},
+		{name: "become", become: "nobody"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, remove, err := writeScript(context.Background(), "echo secret", Options{Become: tt.become, Interpreter: []string{}})
+			require.NoError(t, err)
+
+			info, err := os.Stat(path)
+			require.NoError(t, err)
+			require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+			content, err := os.ReadFile(path)
+			require.NoError(t, err)
+			require.Equal(t, "echo secret", string(content))
+
+			remove()
+			require.NoFileExists(t, path)
+		})
+	}
+}
@@ -1,53 +1,199 @@
 package confible
 
-import "os"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/pelletier/go-toml/v2"
+	"github.com/sj14/confible/internal/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// File is a confible file. The description, default and required
+// struct tags are used for generating the JSON schema.
 type File struct {
-	Settings  Settings   `toml:"settings"`
-	Configs   []Config   `toml:"config"`
-	Commands  []Command  `toml:"commands"`
-	Variables []Variable `toml:"variables"`
+	Settings  Settings   `toml:"settings" json:"settings" yaml:"settings" required:"true"`
+	Configs   []Config   `toml:"config" json:"config" yaml:"config" description:"Configs which are appended to the target files."`
+	Commands  []Command  `toml:"commands" json:"commands" yaml:"commands" description:"Commands which are executed before or after the configs were written."`
+	Variables []Variable `toml:"variables" json:"variables" yaml:"variables" description:"Variables which can be used in the templates with {{ .Var.name }}."`
+	Snippets  []Snippet  `toml:"snippet" json:"snippet" yaml:"snippet" description:"Named templates which can be included with {{ template \"name\" . }}."`
+}
+
+// Format of a confible file.
+type Format string
+
+const (
+	FormatTOML Format = "toml"
+	FormatYAML Format = "yaml"
+	FormatJSON Format = "json"
+)
+
+// FormatFromPath returns the format based on the file extension.
+// Unknown extensions are treated as TOML.
+func FormatFromPath(path string) Format {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".json":
+		return FormatJSON
+	}
+	return FormatTOML
+}
+
+// Decode reads a confible file in the given format. Unknown fields result in an error.
+// For TOML, this is a *toml.StrictMissingError and the returned file contains all known fields.
+func Decode(r io.Reader, format Format) (File, error) {
+	file := File{}
+
+	var err error
+	switch format {
+	case FormatTOML:
+		dec := toml.NewDecoder(r)
+		dec.DisallowUnknownFields()
+		// required for Shell
+		dec.EnableUnmarshalerInterface()
+		err = dec.Decode(&file)
+	case FormatYAML:
+		dec := yaml.NewDecoder(r)
+		dec.KnownFields(true)
+		err = dec.Decode(&file)
+		if errors.Is(err, io.EOF) {
+			// empty file
+			err = nil
+		}
+	case FormatJSON:
+		dec := json.NewDecoder(r)
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&file)
+	default:
+		err = fmt.Errorf("unknown format %q", format)
+	}
+
+	if err != nil {
+		return file, fmt.Errorf("failed unmarshalling config file: %w", err)
+	}
+	return file, nil
 }
 
 type Settings struct {
-	Deactivated bool     `toml:"deactivated"`
-	ID          string   `toml:"id"`
-	OSs         []string `toml:"os"`
-	Archs       []string `toml:"arch"`
+	Deactivated bool     `toml:"deactivated" json:"deactivated" yaml:"deactivated" default:"false" description:"Remove the configs with this id from the targets instead of appending them (like -clean)."`
+	ID          string   `toml:"id" json:"id" yaml:"id" required:"true" description:"Unique identifier which allows to write different configs to the same target."`
+	OSs         []string `toml:"os" json:"os" yaml:"os" description:"Only process the file when the operating system ($GOOS) matches."`
+	Archs       []string `toml:"arch" json:"arch" yaml:"arch" description:"Only process the file when the machine architecture ($GOARCH) matches."`
+	User        string   `toml:"user" json:"user" yaml:"user" description:"Expand '~' to the home directory of this user and create files owned by this user."`
+	Templates   string   `toml:"templates" json:"templates" yaml:"templates" description:"Directory with snippet files, relative to the confible file."`
+	Strict      bool     `toml:"strict" json:"strict" yaml:"strict" default:"false" description:"Fail on missing keys of .Var or .Env instead of rendering <no value>."`
+	After       []string `toml:"after" json:"after" yaml:"after" description:"IDs of other confible files which are processed before this file when they are applied together."`
+	Requires    []string `toml:"requires" json:"requires" yaml:"requires" description:"Like after, but the other files have to be applied together with this file and this file is skipped when one of them failed."`
+}
+
+// BecomeUser returns the user which writes the target with sudo, empty for the current user.
+func (c Config) BecomeUser() string {
+	return becomeUser(c.Sudo, c.Become)
+}
+
+// BecomeUser returns the user which runs the commands with sudo, empty for the current user.
+func (c Command) BecomeUser() string {
+	return becomeUser(c.Sudo, c.Become)
+}
+
+func becomeUser(sudo bool, become string) string {
+	if become == "" && sudo {
+		return "root"
+	}
+	return become
+}
+
+// TemplatesDir returns the templates directory, relative
+// paths are relative to the directory of the confible file.
+func (s Settings) TemplatesDir(confiblePath string) (string, error) {
+	if s.Templates == "" {
+		return "", nil
+	}
+	dir, err := utils.AbsFilepath(s.Templates, nil)
+	if err != nil {
+		return "", err
+	}
+	if filepath.IsAbs(dir) {
+		return dir, nil
+	}
+	return filepath.Join(filepath.Dir(confiblePath), dir), nil
 }
 
 type Config struct {
-	OSs      []string    `toml:"os"`
-	Archs    []string    `toml:"arch"`
-	Priority int64       `toml:"priority"`
-	Path     string      `toml:"path"`
-	Truncate bool        `toml:"truncate"`
-	PermDir  os.FileMode `toml:"perm_dir"`
-	PermFile os.FileMode `toml:"perm_file"`
-	Comment  string      `toml:"comment_symbol"`
-	Append   string      `toml:"append"`
+	Name     string      `toml:"name" json:"name" yaml:"name" description:"Name which can be referenced by on_change of commands."`
+	OSs      []string    `toml:"os" json:"os" yaml:"os" description:"Only write the config when the operating system ($GOOS) matches."`
+	Archs    []string    `toml:"arch" json:"arch" yaml:"arch" description:"Only write the config when the machine architecture ($GOARCH) matches."`
+	Priority int64       `toml:"priority" json:"priority" yaml:"priority" default:"1000" description:"Position of the config in the target, lower values are sorted before other confible parts."`
+	Path     string      `toml:"path" json:"path" yaml:"path" required:"true" description:"The target file. Supports templating, environment variables and '~' or '~username'."`
+	Truncate bool        `toml:"truncate" json:"truncate" yaml:"truncate" default:"false" description:"Erase the target file before writing. With -clean, the target file will be removed."`
+	PermDir  os.FileMode `toml:"perm_dir" json:"perm_dir" yaml:"perm_dir" default:"0o700" description:"Permissions of created directories."`
+	PermFile os.FileMode `toml:"perm_file" json:"perm_file" yaml:"perm_file" default:"0o644" description:"Permissions of the target file."`
+	Sudo     bool        `toml:"sudo" json:"sudo" yaml:"sudo" default:"false" description:"Write the target as root with sudo (like become = \"root\")."`
+	Become   string      `toml:"become" json:"become" yaml:"become" description:"Write the target as this user with sudo. The password is prompted once."`
+	Comment  string      `toml:"comment_symbol" json:"comment_symbol" yaml:"comment_symbol" required:"true" description:"Symbol which is recognized as a comment by the target file."`
+	Append   string      `toml:"append" json:"append" yaml:"append" required:"true" description:"The content which is written to the target (template)."`
 }
 
 type Command struct {
-	OSs          []string `toml:"os"`
-	Archs        []string `toml:"arch"`
-	AfterConfigs bool     `toml:"after_configs"`
-	Exec         []string `toml:"exec"`
+	Name         string            `toml:"name" json:"name" yaml:"name" description:"Name which can be referenced by needs of other commands and prefixes the output of parallel commands."`
+	Needs        []string          `toml:"needs" json:"needs" yaml:"needs" description:"Names of commands which have to succeed before these commands run."`
+	Parallel     bool              `toml:"parallel" json:"parallel" yaml:"parallel" default:"false" description:"Run the commands concurrently with other parallel commands (see -jobs)."`
+	OSs          []string          `toml:"os" json:"os" yaml:"os" description:"Only run the commands when the operating system ($GOOS) matches."`
+	Archs        []string          `toml:"arch" json:"arch" yaml:"arch" description:"Only run the commands when the machine architecture ($GOARCH) matches."`
+	AfterConfigs bool              `toml:"after_configs" json:"after_configs" yaml:"after_configs" default:"false" description:"Run the commands after the configs were written."`
+	AsUser       bool              `toml:"as_user" json:"as_user" yaml:"as_user" default:"false" description:"Run the commands as the user from settings.user or -user."`
+	Sudo         bool              `toml:"sudo" json:"sudo" yaml:"sudo" default:"false" description:"Run the commands as root with sudo (like become = \"root\")."`
+	Become       string            `toml:"become" json:"become" yaml:"become" description:"Run the commands as this user with sudo. The password is prompted once."`
+	Creates      string            `toml:"creates" json:"creates" yaml:"creates" description:"Skip the commands when this path exists (template)."`
+	Unless       string            `toml:"unless" json:"unless" yaml:"unless" description:"Skip the commands when this command succeeds (template)."`
+	OnlyIf       string            `toml:"onlyif" json:"onlyif" yaml:"onlyif" description:"Skip the commands when this command fails (template)."`
+	OnChange     []string          `toml:"on_change" json:"on_change" yaml:"on_change" description:"Names or paths of configs. The commands only run after the configs were written and when one of them changed."`
+	Dir          string            `toml:"dir" json:"dir" yaml:"dir" description:"Working directory of the commands, relative to the confible file. Default: directory of the confible file."`
+	Env          map[string]string `toml:"env" json:"env" yaml:"env" description:"Additional environment variables of the commands."`
+	Shell        Shell             `toml:"shell" json:"shell" yaml:"shell" description:"Shell which runs the commands, e.g. \"bash\" or [\"zsh\", \"-lc\"]. Default: sh -c (cmd /C on Windows)."`
+	Timeout      Duration          `toml:"timeout" json:"timeout" yaml:"timeout" description:"Kill each command when it runs longer, e.g. \"30s\". Default: -timeout flag."`
+	Retries      int               `toml:"retries" json:"retries" yaml:"retries" default:"0" description:"Retry failed commands this many times."`
+	RetryDelay   Duration          `toml:"retry_delay" json:"retry_delay" yaml:"retry_delay" description:"Wait between the retries, e.g. \"5s\"."`
+	IgnoreErrors bool              `toml:"ignore_errors" json:"ignore_errors" yaml:"ignore_errors" default:"false" description:"Continue when a command failed, the failure is reported at the end."`
+	OkExitCodes  []int             `toml:"ok_exit_codes" json:"ok_exit_codes" yaml:"ok_exit_codes" description:"Exit codes which are treated as success. Default: [0]."`
+	Always       bool              `toml:"always" json:"always" yaml:"always" default:"false" description:"Run the commands on every execution, even when they are cached."`
+	Log          string            `toml:"log" json:"log" yaml:"log" description:"File where the output of the commands is appended, relative to the confible file."`
+	Quiet        bool              `toml:"quiet" json:"quiet" yaml:"quiet" default:"false" description:"Only show the output of failed commands."`
+	Stdin        string            `toml:"stdin" json:"stdin" yaml:"stdin" description:"Input of the commands and the script (template)."`
+	Exec         []string          `toml:"exec" json:"exec" yaml:"exec" description:"The commands to execute."`
+	Script       string            `toml:"script" json:"script" yaml:"script" description:"Multi-line script which is written to a temporary file and executed with the interpreter after the commands."`
+	Interpreter  string            `toml:"interpreter" json:"interpreter" yaml:"interpreter" description:"Program which executes the script file, e.g. \"python3\" or \"bash -e\". Default: sh (cmd /C on Windows)."`
 }
 
 type Variable struct {
-	OSs   []string `toml:"os"`
-	Archs []string `toml:"arch"`
-	Exec  []VarCmd `toml:"exec"`
-	Input []VarVal `toml:"input"`
+	OSs   []string `toml:"os" json:"os" yaml:"os" description:"Only use the variables when the operating system ($GOOS) matches."`
+	Archs []string `toml:"arch" json:"arch" yaml:"arch" description:"Only use the variables when the machine architecture ($GOARCH) matches."`
+	Exec  []VarCmd `toml:"exec" json:"exec" yaml:"exec" description:"Variables where the command output is assigned."`
+	Input []VarVal `toml:"input" json:"input" yaml:"input" description:"Variables which are read from an input prompt."`
 }
 
 type VarVal struct {
-	VariableName string `toml:"var"`
-	Prompt       string `toml:"prompt"`
+	VariableName string `toml:"var" json:"var" yaml:"var" required:"true" description:"Name of the variable."`
+	Prompt       string `toml:"prompt" json:"prompt" yaml:"prompt" description:"The prompt message."`
+	Secret       bool   `toml:"secret" json:"secret" yaml:"secret" default:"false" description:"Don't show the value in the output and mask it when listing the cache."`
 }
 
 type VarCmd struct {
-	VariableName string `toml:"var"`
-	Cmd          string `toml:"cmd"`
+	VariableName string            `toml:"var" json:"var" yaml:"var" required:"true" description:"Name of the variable."`
+	Cmd          string            `toml:"cmd" json:"cmd" yaml:"cmd" required:"true" description:"The command whose output is assigned."`
+	Dir          string            `toml:"dir" json:"dir" yaml:"dir" description:"Working directory of the command, relative to the confible file. Default: directory of the confible file."`
+	Env          map[string]string `toml:"env" json:"env" yaml:"env" description:"Additional environment variables of the command."`
+	Shell        Shell             `toml:"shell" json:"shell" yaml:"shell" description:"Shell which runs the command, e.g. \"bash\" or [\"zsh\", \"-lc\"]. Default: sh -c (cmd /C on Windows)."`
+	Timeout      Duration          `toml:"timeout" json:"timeout" yaml:"timeout" description:"Kill the command when it runs longer, e.g. \"30s\". Default: -timeout flag."`
+}
+
+type Snippet struct {
+	Name string `toml:"name" json:"name" yaml:"name" required:"true" description:"Name of the snippet."`
+	Text string `toml:"text" json:"text" yaml:"text" required:"true" description:"The snippet (template)."`
 }
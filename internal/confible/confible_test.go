@@ -0,0 +1,144 @@
+package confible
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecode(t *testing.T) {
+	want := File{
+		Settings: Settings{ID: "vimrc", OSs: []string{"linux"}},
+		Configs: []Config{
+			{Path: "~/.vimrc", Comment: "\"", PermFile: 0o600, Append: "set number\n"},
+		},
+		Commands: []Command{{Exec: []string{"echo hello"}}},
+	}
+
+	tests := []struct {
+		name    string
+		format  Format
+		content string
+		want    File
+		wantErr bool
+	}{
+		{
+			name:   "toml",
+			format: FormatTOML,
+			content: `
+[settings]
+id = "vimrc"
+os = ["linux"]
+
+[[config]]
+path = "~/.vimrc"
+comment_symbol = '"'
+perm_file = 0o600
+append = """
+set number
+"""
+
+[[commands]]
+exec = ["echo hello"]
+`,
+			want: want,
+		},
+		{
+			name:   "yaml",
+			format: FormatYAML,
+			content: `
+settings:
+  id: vimrc
+  os: [linux]
+config:
+  - path: ~/.vimrc
+    comment_symbol: '"'
+    perm_file: 0o600
+    append: |
+      set number
+commands:
+  - exec: [echo hello]
+`,
+			want: want,
+		},
+		{
+			name:   "json",
+			format: FormatJSON,
+			content: `{
+  "settings": {"id": "vimrc", "os": ["linux"]},
+  "config": [{"path": "~/.vimrc", "comment_symbol": "\"", "perm_file": 384, "append": "set number\n"}],
+  "commands": [{"exec": ["echo hello"]}]
+}`,
+			want: want,
+		},
+		{
+			name:    "toml unknown field",
+			format:  FormatTOML,
+			content: "[settings]\nid = \"x\"\nfoo = 1\n",
+			want:    File{Settings: Settings{ID: "x"}},
+			wantErr: true,
+		},
+		{
+			name:    "yaml unknown field",
+			format:  FormatYAML,
+			content: "settings:\n  id: x\n  foo: 1\n",
+			want:    File{Settings: Settings{ID: "x"}},
+			wantErr: true,
+		},
+		{
+			name:    "json unknown field",
+			format:  FormatJSON,
+			content: `{"settings": {"foo": 1}}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode(strings.NewReader(tt.content), tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Decode() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestFormatFromPath(t *testing.T) {
+	require.Equal(t, FormatTOML, FormatFromPath("vim.toml"))
+	require.Equal(t, FormatTOML, FormatFromPath("vim"))
+	require.Equal(t, FormatYAML, FormatFromPath("vim.yaml"))
+	require.Equal(t, FormatYAML, FormatFromPath("vim.YML"))
+	require.Equal(t, FormatJSON, FormatFromPath("path/to/vim.json"))
+}
+
+func TestDecodeShell(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  Format
+		content string
+		want    Shell
+		wantErr bool
+	}{
+		{name: "toml string", format: FormatTOML, content: "[[commands]]\nshell = \"bash\"", want: Shell{"bash", "-c"}},
+		{name: "toml list", format: FormatTOML, content: "[[commands]]\nshell = [\"zsh\", \"-lc\"]", want: Shell{"zsh", "-lc"}},
+		{name: "toml invalid", format: FormatTOML, content: "[[commands]]\nshell = 1", wantErr: true},
+		{name: "yaml string", format: FormatYAML, content: "commands:\n  - shell: bash", want: Shell{"bash", "-c"}},
+		{name: "yaml list", format: FormatYAML, content: "commands:\n  - shell: [zsh, -lc]", want: Shell{"zsh", "-lc"}},
+		{name: "json string", format: FormatJSON, content: `{"commands": [{"shell": "bash"}]}`, want: Shell{"bash", "-c"}},
+		{name: "json list", format: FormatJSON, content: `{"commands": [{"shell": ["zsh", "-lc"]}]}`, want: Shell{"zsh", "-lc"}},
+		{name: "json invalid", format: FormatJSON, content: `{"commands": [{"shell": 1}]}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode(strings.NewReader(tt.content), tt.format)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.Nil(t, err)
+			require.Equal(t, tt.want, got.Commands[0].Shell)
+		})
+	}
+}
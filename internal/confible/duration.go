@@ -0,0 +1,32 @@
+package confible
+
+import (
+	"fmt"
+	"time"
+)
+
+// Duration is a time.Duration which is given as a string, e.g. "30s" or "1m30s".
+type Duration time.Duration
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid duration: %v", err)
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// JSONSchema implements schema.Schemer.
+func (Duration) JSONSchema() map[string]any {
+	return map[string]any{
+		"type":    "string",
+		"pattern": `^(\d+(\.\d+)?(ns|us|µs|ms|s|m|h))+$`,
+	}
+}
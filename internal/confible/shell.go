@@ -0,0 +1,85 @@
+package confible
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pelletier/go-toml/v2/unstable"
+	"gopkg.in/yaml.v3"
+)
+
+// Shell is the shell and its arguments, the command is added as the last argument.
+// It can be given as a string (e.g. "bash", which is run as "bash -c <cmd>")
+// or as a list (e.g. ["zsh", "-lc"]).
+type Shell []string
+
+func shellFromString(s string) Shell {
+	if s == "" {
+		return nil
+	}
+	return Shell{s, "-c"}
+}
+
+// UnmarshalTOML implements unstable.Unmarshaler.
+func (s *Shell) UnmarshalTOML(node *unstable.Node) error {
+	switch node.Kind {
+	case unstable.String:
+		*s = shellFromString(string(node.Data))
+		return nil
+	case unstable.Array:
+		shell := Shell{}
+		it := node.Children()
+		for it.Next() {
+			if it.Node().Kind != unstable.String {
+				return fmt.Errorf("shell: expected a list of strings but got %v", it.Node().Kind)
+			}
+			shell = append(shell, string(it.Node().Data))
+		}
+		*s = shell
+		return nil
+	}
+	return fmt.Errorf("shell: expected a string or a list of strings but got %v", node.Kind)
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (s *Shell) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		var shell string
+		if err := node.Decode(&shell); err != nil {
+			return err
+		}
+		*s = shellFromString(shell)
+		return nil
+	}
+	var shell []string
+	if err := node.Decode(&shell); err != nil {
+		return err
+	}
+	*s = shell
+	return nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *Shell) UnmarshalJSON(data []byte) error {
+	var shell string
+	if err := json.Unmarshal(data, &shell); err == nil {
+		*s = shellFromString(shell)
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("shell: expected a string or a list of strings")
+	}
+	*s = list
+	return nil
+}
+
+// JSONSchema implements schema.Schemer.
+func (Shell) JSONSchema() map[string]any {
+	return map[string]any{
+		"oneOf": []any{
+			map[string]any{"type": "string"},
+			map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+		},
+	}
+}
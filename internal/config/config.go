@@ -2,19 +2,23 @@ package config
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"os"
+	"os/user"
 	"path/filepath"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
-	"text/template"
 	"time"
 
+	"github.com/sj14/confible/internal/cache"
 	"github.com/sj14/confible/internal/confible"
+	"github.com/sj14/confible/internal/source"
+	"github.com/sj14/confible/internal/template"
 	"github.com/sj14/confible/internal/utils"
 	"github.com/sj14/confible/internal/variable"
 	"golang.org/x/exp/slices"
@@ -25,26 +29,106 @@ const (
 	footer = "CONFIBLE END"
 )
 
-// validate and aggregate configs which target the same file
-func aggregateConfigs(configs []confible.Config) []confible.Config {
+// CheckConfig returns the problems of a single config,
+// e.g. missing required fields or invalid permissions.
+func CheckConfig(cfg confible.Config) []error {
+	var errs []error
+	if cfg.Append == "" {
+		errs = append(errs, errors.New("missing append"))
+	}
+	if cfg.Path == "" {
+		errs = append(errs, errors.New("missing target"))
+	}
+	if cfg.Comment == "" {
+		errs = append(errs, errors.New("missing comment symbol"))
+	}
+	if cfg.PermDir&^os.ModePerm != 0 {
+		errs = append(errs, fmt.Errorf("invalid perm_dir %#o", uint32(cfg.PermDir)))
+	}
+	if cfg.PermFile&^os.ModePerm != 0 {
+		errs = append(errs, fmt.Errorf("invalid perm_file %#o", uint32(cfg.PermFile)))
+	}
+	return errs
+}
+
+// CheckConflicts returns the conflicting settings of two configs targeting the same path.
+func CheckConflicts(old, cfg confible.Config) []error {
+	oldPriority, priority := old.Priority, cfg.Priority
+	if oldPriority == 0 {
+		oldPriority = DefaultPriority
+	}
+	if priority == 0 {
+		priority = DefaultPriority
+	}
+
+	var errs []error
+	if old.Truncate != cfg.Truncate {
+		errs = append(errs, fmt.Errorf("%q should be truncated and also not be truncated", cfg.Path))
+	}
+	if old.PermDir != cfg.PermDir {
+		errs = append(errs, fmt.Errorf("%q has perm_dir %v and perm_dir %v", cfg.Path, old.PermDir, cfg.PermDir))
+	}
+	if old.PermFile != cfg.PermFile {
+		errs = append(errs, fmt.Errorf("%q has perm_file %v and perm_file %v", cfg.Path, old.PermFile, cfg.PermFile))
+	}
+	if oldPriority != priority {
+		errs = append(errs, fmt.Errorf("%q has priority %v and priority %v", cfg.Path, oldPriority, priority))
+	}
+	if old.BecomeUser() != cfg.BecomeUser() {
+		errs = append(errs, fmt.Errorf("%q is written as user %q and as user %q", cfg.Path, old.BecomeUser(), cfg.BecomeUser()))
+	}
+	return errs
+}
+
+// validate, render and aggregate configs which target the same file.
+// Configs which don't match the operating system or architecture are skipped.
+// The appended texts are only rendered in append mode. The returned names
+// map the names of the configs to their target paths.
+func aggregateConfigs(confiblePath string, confibleFile confible.File, usr *user.User, td template.Data, mode ContentMode) ([]confible.Config, map[string][]string, error) {
 	// the key is the path of the config file
 	configsMap := make(map[string]confible.Config)
+	names := make(map[string][]string)
 
-	for _, cfg := range configs {
-		if cfg.Append == "" {
-			log.Fatalf("missing append\n")
-		}
-		if cfg.Path == "" {
-			log.Fatalf("missing target\n")
-		}
-		if cfg.Comment == "" {
-			log.Fatalf("missing comment symbol\n")
+	for i, cfg := range confibleFile.Configs {
+		// position of the config for error messages
+		pos := fmt.Sprintf("%s: [[config]] #%d", confiblePath, i+1)
+
+		if errs := CheckConfig(cfg); len(errs) != 0 {
+			return nil, nil, fmt.Errorf("%s: %v", pos, errs[0])
 		}
 		if cfg.Priority == 0 {
 			cfg.Priority = DefaultPriority
 		}
 
-		cfg.Path = utils.AbsFilepath(cfg.Path)
+		// check if we can skip this config
+		if len(cfg.OSs) != 0 && !slices.Contains(cfg.OSs, runtime.GOOS) {
+			log.Printf("[%v] skipping as operating system %q is not matching config filter %q\n", confibleFile.Settings.ID, runtime.GOOS, cfg.OSs)
+			continue
+		}
+		if len(cfg.Archs) != 0 && !slices.Contains(cfg.Archs, runtime.GOARCH) {
+			log.Printf("[%v] skipping as machine arch %q is not matching config filter %q\n", confibleFile.Settings.ID, runtime.GOARCH, cfg.Archs)
+			continue
+		}
+
+		path, err := template.Render("path", cfg.Path, td)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s (%s): %v", pos, cfg.Path, err)
+		}
+		cfg.Path, err = utils.AbsFilepath(path, usr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s (%s): %v", pos, path, err)
+		}
+
+		if cfg.Name != "" && !slices.Contains(names[cfg.Name], cfg.Path) {
+			names[cfg.Name] = append(names[cfg.Name], cfg.Path)
+		}
+
+		if mode == ModeAppend {
+			cfg.Append, err = template.Render("append", cfg.Append, td)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s (%s): %v", pos, cfg.Path, err)
+			}
+		}
 
 		// add a new config path (no need for aggregating)
 		if _, ok := configsMap[cfg.Path]; !ok {
@@ -57,17 +141,8 @@ func aggregateConfigs(configs []confible.Config) []confible.Config {
 		if old.Comment != cfg.Comment {
 			log.Printf("multiple comment styles for %q (%q and %q) using %q\n", cfg.Path, old.Comment, cfg.Comment, old.Comment)
 		}
-		if old.Truncate != cfg.Truncate {
-			log.Fatalf("%q should be truncated and also not be truncated\n", cfg.Path)
-		}
-		if old.PermDir != cfg.PermDir {
-			log.Fatalf("%q has perm_dir %v and perm_dir %v\n", cfg.Path, old.PermDir, cfg.PermDir)
-		}
-		if old.PermFile != cfg.PermFile {
-			log.Fatalf("%q has perm_file %v and perm_file %v\n", cfg.Path, old.PermFile, cfg.PermFile)
-		}
-		if old.Priority != cfg.Priority {
-			log.Fatalf("%q has priority %v and priority %v\n", cfg.Path, old.Priority, cfg.Priority)
+		if errs := CheckConflicts(old, cfg); len(errs) != 0 {
+			return nil, nil, fmt.Errorf("%s: %v", pos, errs[0])
 		}
 
 		old.Append += cfg.Append
@@ -79,41 +154,59 @@ func aggregateConfigs(configs []confible.Config) []confible.Config {
 		aggregated = append(aggregated, cfg)
 	}
 
-	return aggregated
+	return aggregated, names, nil
 }
 
-func ModifyTargetFiles(confibleFile confible.File, useCached bool, cacheFilepath string, mode ContentMode) error {
-	configs := aggregateConfigs(confibleFile.Configs)
+// TemplateData returns the data for rendering the templates of the confible file.
+// In append mode, the variables are parsed (and maybe prompted for) with their commands
+// running in the directory of the confible file. Other modes use the cached variables.
+func TemplateData(ctx context.Context, confiblePath string, confibleFile confible.File, useCached bool, c *cache.Cache, mode ContentMode, usr *user.User) (template.Data, error) {
+	snippets, err := template.LoadSnippets(confibleFile.Settings.Templates, confibleFile.Snippets)
+	if err != nil {
+		return template.Data{}, err
+	}
 
-	var td TemplateData
+	td := template.NewData(nil, usr).WithSnippets(snippets).WithStrict(confibleFile.Settings.Strict)
 
 	if mode == ModeAppend {
-		// only create template when we are not in a clean mode
-		variableMap, err := variable.Parse(confibleFile.Settings.ID, confibleFile.Variables, useCached, cacheFilepath)
+		// only parse (and maybe prompt for) variables when we are not in a clean mode
+		td.Var, err = variable.Parse(ctx, confibleFile.Settings.ID, confibleFile.Variables, useCached, c, source.Dir(confiblePath), td)
 		if err != nil {
-			return err
+			return template.Data{}, err
 		}
+	} else {
+		// the paths might still contain variables, use the cached ones
+		td.Var = c.LoadVars(confibleFile.Settings.ID)
+	}
+	return td, nil
+}
 
-		td = TemplateData{
-			Env: utils.GetEnvMap(),
-			Var: variableMap,
-		}
+// ModifyTargetFiles writes the configs to their targets. Paths starting with '~' are
+// expanded to the home directory of usr and created files and directories are owned
+// by usr. The current user is used when usr is nil. All templates are rendered with
+// td before any target is written. The confiblePath is used for error messages.
+// Returns the paths and names of the targets whose content changed. When the context
+// is done, no further targets are written.
+func ModifyTargetFiles(ctx context.Context, confiblePath string, confibleFile confible.File, td template.Data, mode ContentMode, usr *user.User) ([]string, error) {
+	configs, names, err := aggregateConfigs(confiblePath, confibleFile, usr, td, mode)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, cfg := range configs {
-		// check if we can skip this config
-		if len(cfg.OSs) != 0 && !slices.Contains(cfg.OSs, runtime.GOOS) {
-			log.Printf("[%v] skipping as operating system %q is not matching config filter %q\n", confibleFile.Settings.ID, runtime.GOOS, cfg.OSs)
-			continue
-		}
-		if len(cfg.Archs) != 0 && !slices.Contains(cfg.Archs, runtime.GOARCH) {
-			log.Printf("[%v] skipping as machine arch %q is not matching config filter %q\n", confibleFile.Settings.ID, runtime.GOARCH, cfg.Archs)
-			continue
+	var changed []string
+	changedPath := func(path string) {
+		changed = append(changed, path)
+		for name, paths := range names {
+			if slices.Contains(paths, path) && !slices.Contains(changed, name) {
+				changed = append(changed, name)
+			}
 		}
+	}
 
-		fileFlags := os.O_CREATE
-		if cfg.Truncate {
-			fileFlags = fileFlags | os.O_TRUNC
+	for _, cfg := range configs {
+		// don't write further targets when confible was interrupted
+		if err := ctx.Err(); err != nil {
+			return changed, err
 		}
 
 		permDir := os.FileMode(0o700)
@@ -126,71 +219,99 @@ func ModifyTargetFiles(confibleFile confible.File, useCached bool, cacheFilepath
 			permFile = cfg.PermFile
 		}
 
+		fs := newTargetFS(cfg.BecomeUser(), usr)
+
 		// create folder for the target file if it doesn't exist
-		if err := os.MkdirAll(filepath.Dir(cfg.Path), permDir); err != nil {
-			return fmt.Errorf("failed creating target folder (%v): %v", cfg.Path, err)
+		if err := fs.MkdirAll(ctx, filepath.Dir(cfg.Path), permDir); err != nil {
+			return changed, fmt.Errorf("failed creating target folder (%v): %v", cfg.Path, err)
 		}
 
-		// open the target file (doesn't create the folder when it doesn't exit)
-		targetFile, err := os.OpenFile(cfg.Path, fileFlags, permFile)
+		exists, err := fs.Exists(ctx, cfg.Path)
 		if err != nil {
-			return fmt.Errorf("failed reading target file (%v): %v", cfg.Path, err)
+			return changed, fmt.Errorf("failed reading target file (%v): %v", cfg.Path, err)
 		}
-		defer targetFile.Close()
 
-		existingContent := &strings.Builder{}
-		_, err = io.Copy(existingContent, targetFile)
+		previousContent, err := fs.ReadFile(ctx, cfg.Path)
 		if err != nil {
-			return err
+			return changed, fmt.Errorf("failed reading target file (%v): %v", cfg.Path, err)
+		}
+
+		// the configs are appended to the erased file
+		existingContent := previousContent
+		if cfg.Truncate {
+			existingContent = ""
 		}
 
 		// process new file content
 		var newContent string
 		switch mode {
 		case ModeAppend:
-			newContent, err = appendConfig(existingContent.String(), cfg.Priority, confibleFile.Settings.ID, cfg.Comment, cfg.Append, td, time.Now())
+			newContent, err = appendConfig(existingContent, cfg.Priority, confibleFile.Settings.ID, cfg.Comment, cfg.Append, time.Now())
 			if err != nil {
-				return fmt.Errorf("failed appending new content: %w", err)
+				return changed, fmt.Errorf("failed appending new content: %w", err)
 			}
 		case ModeCleanID:
 			if cfg.Truncate {
+				if !exists {
+					continue
+				}
+				if err := fs.Remove(ctx, cfg.Path); err != nil {
+					return changed, fmt.Errorf("failed deleting target file (%v): %v", cfg.Path, err)
+				}
 				log.Printf("[%v] deleted config %q as truncate was enabled\n", confibleFile.Settings.ID, cfg.Path)
-				return os.Remove(cfg.Path)
+				changedPath(cfg.Path)
+				continue
 			}
 
-			configs, err := extractConfigs(existingContent.String())
+			configs, err := extractConfigs(existingContent)
 			if err != nil {
-				return fmt.Errorf("failed cleaning id config: %w", err)
+				return changed, fmt.Errorf("failed cleaning id config: %w", err)
 			}
 
 			// we want to clean this config
 			configs = removeConfig(configs, confibleFile.Settings.ID)
 
 			// write new content without config
-			newContent = removeConfigs(existingContent.String())
+			newContent = removeConfigs(existingContent)
 
 			for _, cfg := range configs {
 				newContent = newContent + "\n\n" + strings.TrimSpace(cfg.content)
 			}
 			newContent = newContent + "\n"
 		default:
-			return fmt.Errorf("wrong or no mode specified")
+			return changed, fmt.Errorf("wrong or no mode specified")
 		}
 
 		// write content to the file
-		if err := os.WriteFile(cfg.Path, []byte(newContent), permFile); err != nil {
-			return fmt.Errorf("failed writing target file (%v): %v", cfg.Path, err)
+		if err := fs.WriteFile(ctx, cfg.Path, newContent, permFile); err != nil {
+			return changed, fmt.Errorf("failed writing target file (%v): %v", cfg.Path, err)
 		}
 
-		// explicitly set permissions as the file might already have existed
-		// and previous calls don't adjust it when it exists.
-		if err := os.Chmod(cfg.Path, permFile); err != nil {
-			return fmt.Errorf("failed setting file permisions %q on %q: %v", permFile, cfg.Path, err)
+		if !exists || withoutDates(previousContent) != withoutDates(newContent) {
+			changedPath(cfg.Path)
 		}
 
 		log.Printf("[%v] wrote config %q\n", confibleFile.Settings.ID, cfg.Path)
 	}
-	return nil
+	return changed, nil
+}
+
+// withoutDates removes the date lines below the headers, which
+// change on every write, for comparing the content of targets.
+func withoutDates(content string) string {
+	result := strings.Builder{}
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	afterHeader := false
+	for scanner.Scan() {
+		if afterHeader {
+			afterHeader = false
+			continue
+		}
+		afterHeader = strings.Contains(scanner.Text(), header)
+		result.WriteString(scanner.Text() + "\n")
+	}
+	return strings.TrimSpace(result.String())
 }
 
 type ContentMode uint8
@@ -303,11 +424,6 @@ func generateFooterWithID(id string) string {
 	return fmt.Sprintf(footer+" id: %q", id)
 }
 
-type TemplateData struct {
-	Env map[string]string
-	Var map[string]string
-}
-
 func removeConfigs(existing string) string {
 	result := strings.Builder{}
 
@@ -331,20 +447,12 @@ func removeConfigs(existing string) string {
 	return strings.TrimSpace(result.String())
 }
 
-func newConfig(comment, id, appendText string, priority int64, td TemplateData, now time.Time) confibleConfig {
+func newConfig(comment, id, appendText string, priority int64, now time.Time) confibleConfig {
 	content := strings.Builder{}
 	// header
 	content.WriteString(comment + " ~~~ " + generateHeaderWithIDAndPriority(id, priority) + " ~~~\n" + comment + " " + now.Format(time.RFC1123) + "\n")
 
-	templ, err := template.New("").Parse(strings.TrimSpace(appendText))
-	if err != nil {
-		panic(err)
-	}
-
-	err = templ.Execute(&content, td)
-	if err != nil {
-		panic(err)
-	}
+	content.WriteString(strings.TrimSpace(appendText))
 
 	// footer
 	content.WriteString("\n" + comment + " ~~~ " + generateFooterWithID(id) + " ~~~\n")
@@ -356,7 +464,7 @@ func newConfig(comment, id, appendText string, priority int64, td TemplateData,
 	}
 }
 
-func appendConfig(existing string, priority int64, id, comment, appendText string, td TemplateData, now time.Time) (string, error) {
+func appendConfig(existing string, priority int64, id, comment, appendText string, now time.Time) (string, error) {
 	if priority == 0 {
 		priority = DefaultPriority
 	}
@@ -371,7 +479,7 @@ func appendConfig(existing string, priority int64, id, comment, appendText strin
 	newConfigs = removeConfig(newConfigs, id)
 
 	// add new or updated config
-	newConfigs = append(newConfigs, newConfig(comment, id, appendText, priority, td, now))
+	newConfigs = append(newConfigs, newConfig(comment, id, appendText, priority, now))
 
 	// start new content
 	newContent := strings.Builder{}
@@ -1,11 +1,14 @@
 package config
 
 import (
+	"context"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/sj14/confible/internal/confible"
+	"github.com/sj14/confible/internal/template"
 	"github.com/sj14/confible/internal/utils"
 	"github.com/stretchr/testify/require"
 )
@@ -20,31 +23,11 @@ func TestAppendContent(t *testing.T) {
 		now        time.Time
 	}
 	tests := []struct {
-		name        string
-		customSetup func()
-		args        args
-		want        string
-		wantErr     bool
+		name    string
+		args    args
+		want    string
+		wantErr bool
 	}{
-		{
-			name: "templating",
-			customSetup: func() {
-				err := os.Setenv("TEST_ENV", "YOLO!!1")
-				require.Nil(t, err)
-			},
-			args: args{
-				existing:   "",
-				id:         "123",
-				comment:    "//",
-				appendText: "new line 1\n{{ .Env.TEST_ENV }}\nnew line 2",
-			},
-			want: `// ~~~ CONFIBLE START id: "123" priority: "1000" ~~~
-// Mon, 01 Jan 0001 00:00:00 UTC
-new line 1
-YOLO!!1
-new line 2
-// ~~~ CONFIBLE END id: "123" ~~~`,
-		},
 		{
 			name: "empty file",
 			args: args{
@@ -169,11 +152,7 @@ new line 2
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if tt.customSetup != nil {
-				tt.customSetup()
-			}
-
-			got, err := appendConfig(tt.args.existing, tt.args.priority, tt.args.id, tt.args.comment, tt.args.appendText, TemplateData{Env: utils.GetEnvMap()}, tt.args.now)
+			got, err := appendConfig(tt.args.existing, tt.args.priority, tt.args.id, tt.args.comment, tt.args.appendText, tt.args.now)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("appendContent() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -186,19 +165,25 @@ new line 2
 
 func TestAggregateConfigs(t *testing.T) {
 	tests := []struct {
-		name    string
-		configs []confible.Config
-		want    []confible.Config
+		name        string
+		customSetup func()
+		configs     []confible.Config
+		td          template.Data
+		want        []confible.Config
+		wantNames   map[string][]string
+		wantErr     string
 	}{
 		{
 			name: "combine",
 			configs: []confible.Config{
 				{
+					Name:    "test",
 					Comment: "#",
 					Path:    "/tmp/test",
 					Append:  "line 1\n",
 				},
 				{
+					Name:    "test",
 					Comment: "//",
 					Path:    "/tmp/test",
 					Append:  "line 2\n",
@@ -206,18 +191,104 @@ func TestAggregateConfigs(t *testing.T) {
 			},
 			want: []confible.Config{
 				{
+					Name:     "test",
 					Comment:  "#",
 					Path:     "/tmp/test",
 					Append:   "line 1\nline 2\n",
 					Priority: DefaultPriority,
 				},
 			},
+			wantNames: map[string][]string{"test": {"/tmp/test"}},
+		},
+		{
+			name: "templated path",
+			configs: []confible.Config{
+				{
+					Comment: "#",
+					Path:    `{{ .Env.XDG_CONFIG_HOME | default "/tmp/.config" }}/{{ .Var.app }}/config`,
+					Append:  "line 1\n",
+				},
+			},
+			td: template.Data{Env: map[string]string{}, Var: map[string]string{"app": "git"}},
+			want: []confible.Config{
+				{
+					Comment:  "#",
+					Path:     "/tmp/.config/git/config",
+					Append:   "line 1\n",
+					Priority: DefaultPriority,
+				},
+			},
+		},
+		{
+			name: "templating",
+			customSetup: func() {
+				err := os.Setenv("TEST_ENV", "YOLO!!1")
+				require.Nil(t, err)
+			},
+			configs: []confible.Config{
+				{
+					Comment: "//",
+					Path:    "/tmp/test",
+					Append:  "new line 1\n{{ .Env.TEST_ENV }}\nnew line 2",
+				},
+			},
+			want: []confible.Config{
+				{
+					Comment:  "//",
+					Path:     "/tmp/test",
+					Append:   "new line 1\nYOLO!!1\nnew line 2",
+					Priority: DefaultPriority,
+				},
+			},
+		},
+		{
+			name: "template error",
+			configs: []confible.Config{
+				{
+					Comment: "#",
+					Path:    "/tmp/test",
+					Append:  "line 1\n",
+				},
+				{
+					Comment: "#",
+					Path:    "/tmp/test",
+					Append:  "line 1\nline 2 {{ .Var.missing | upper }}\n",
+				},
+			},
+			td:      template.Data{}.WithStrict(true),
+			wantErr: `test.toml: [[config]] #2 (/tmp/test): template: append:2:14: executing "append" at <.Var.missing>: map has no entry for key "missing"`,
+		},
+		{
+			name: "missing append",
+			configs: []confible.Config{
+				{
+					Comment: "#",
+					Path:    "/tmp/test",
+				},
+			},
+			wantErr: "test.toml: [[config]] #1: missing append",
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := aggregateConfigs(tt.configs)
+			if tt.customSetup != nil {
+				tt.customSetup()
+			}
+			if tt.td.Env == nil {
+				tt.td.Env = utils.GetEnvMap()
+			}
+
+			got, gotNames, err := aggregateConfigs("test.toml", confible.File{Configs: tt.configs}, nil, tt.td, ModeAppend)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.Nil(t, err)
 			require.Equal(t, tt.want, got)
+			if tt.wantNames == nil {
+				tt.wantNames = map[string][]string{}
+			}
+			require.Equal(t, tt.wantNames, gotNames)
 		})
 	}
 }
@@ -331,3 +402,50 @@ func TestExtractPriority(t *testing.T) {
 		})
 	}
 }
+
+func TestWithoutDates(t *testing.T) {
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	first, err := appendConfig("existing line", 0, "123", "#", "new line", now)
+	require.Nil(t, err)
+	second, err := appendConfig(first, 0, "123", "#", "new line", now.Add(time.Hour))
+	require.Nil(t, err)
+	changed, err := appendConfig(first, 0, "123", "#", "changed line", now.Add(time.Hour))
+	require.Nil(t, err)
+
+	require.NotEqual(t, first, second)
+	require.Equal(t, withoutDates(first), withoutDates(second))
+	require.NotEqual(t, withoutDates(first), withoutDates(changed))
+}
+
+func TestModifyTargetFilesClean(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first")
+	second := filepath.Join(dir, "second")
+	appended := filepath.Join(dir, "appended")
+	missing := filepath.Join(dir, "missing")
+
+	file := confible.File{
+		Settings: confible.Settings{ID: "test"},
+		Configs: []confible.Config{
+			{Path: missing, Comment: "#", Truncate: true, Append: "missing"},
+			{Path: first, Comment: "#", Truncate: true, Append: "first"},
+			{Path: second, Comment: "#", Truncate: true, Append: "second"},
+			{Path: appended, Comment: "#", Append: "appended"},
+		},
+	}
+	_, err := ModifyTargetFiles(context.Background(), "test.toml", file, template.Data{}, ModeAppend, nil)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(missing))
+
+	changed, err := ModifyTargetFiles(context.Background(), "test.toml", file, template.Data{}, ModeCleanID, nil)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{first, second, appended}, changed)
+
+	for _, path := range []string{first, second, missing} {
+		require.NoFileExists(t, path)
+	}
+	content, err := os.ReadFile(appended)
+	require.NoError(t, err)
+	require.NotContains(t, string(content), "appended")
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+
+	"github.com/sj14/confible/internal/become"
+	"github.com/sj14/confible/internal/utils"
+)
+
+// targetFS contains the file operations for writing the targets.
+type targetFS interface {
+	MkdirAll(ctx context.Context, dir string, perm os.FileMode) error
+	Exists(ctx context.Context, path string) (bool, error)
+	// ReadFile returns an empty content when the file doesn't exist.
+	ReadFile(ctx context.Context, path string) (string, error)
+	WriteFile(ctx context.Context, path, content string, perm os.FileMode) error
+	Remove(ctx context.Context, path string) error
+}
+
+// newTargetFS returns the file operations of the current user
+// or of the become user with sudo when it's not empty.
+func newTargetFS(becomeUser string, usr *user.User) targetFS {
+	if becomeUser != "" {
+		return sudoFS{user: becomeUser}
+	}
+	return localFS{usr: usr}
+}
+
+// localFS writes the targets as the current user. Created
+// files and directories are owned by usr (when not nil).
+type localFS struct {
+	usr *user.User
+}
+
+func (fs localFS) MkdirAll(_ context.Context, dir string, perm os.FileMode) error {
+	return utils.MkdirAll(dir, perm, fs.usr)
+}
+
+func (fs localFS) Exists(_ context.Context, path string) (bool, error) {
+	_, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (fs localFS) ReadFile(_ context.Context, path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	return string(content), err
+}
+
+func (fs localFS) WriteFile(ctx context.Context, path, content string, perm os.FileMode) error {
+	// only change the owner of files we create, not of existing ones (e.g. /etc/hosts)
+	exists, err := fs.Exists(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path, []byte(content), perm); err != nil {
+		return err
+	}
+
+	// explicitly set permissions as the file might already have existed
+	// and previous calls don't adjust it when it exists.
+	if err := os.Chmod(path, perm); err != nil {
+		return fmt.Errorf("failed setting file permisions %q: %v", perm, err)
+	}
+
+	if !exists {
+		return utils.Chown(path, fs.usr)
+	}
+	return nil
+}
+
+func (fs localFS) Remove(_ context.Context, path string) error {
+	return os.Remove(path)
+}
+
+// sudoFS writes the targets as another user with sudo.
+type sudoFS struct {
+	user string
+}
+
+func (fs sudoFS) MkdirAll(ctx context.Context, dir string, perm os.FileMode) error {
+	_, err := become.Run(ctx, fs.user, nil, "mkdir", "-p", "-m", fmt.Sprintf("%o", perm.Perm()), "--", dir)
+	return err
+}
+
+func (fs sudoFS) Exists(ctx context.Context, path string) (bool, error) {
+	out, err := become.Run(ctx, fs.user, nil, "sh", "-c", `if [ -e "$1" ]; then echo exists; fi`, "sh", path)
+	return strings.TrimSpace(string(out)) == "exists", err
+}
+
+func (fs sudoFS) ReadFile(ctx context.Context, path string) (string, error) {
+	out, err := become.Run(ctx, fs.user, nil, "sh", "-c", `if [ -e "$1" ]; then cat -- "$1"; fi`, "sh", path)
+	return string(out), err
+}
+
+func (fs sudoFS) WriteFile(ctx context.Context, path, content string, perm os.FileMode) error {
+	_, err := become.Run(ctx, fs.user, strings.NewReader(content), "sh", "-c", `cat > "$1" && chmod "$2" "$1"`, "sh", path, fmt.Sprintf("%o", perm.Perm()))
+	return err
+}
+
+func (fs sudoFS) Remove(ctx context.Context, path string) error {
+	_, err := become.Run(ctx, fs.user, nil, "rm", "--", path)
+	return err
+}
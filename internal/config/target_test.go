@@ -0,0 +1,71 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTargetFS(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sudo is not supported on windows")
+	}
+
+	// fake sudo which runs the command as the current user
+	bin := t.TempDir()
+	sudo := "#!/bin/sh\nwhile [ \"$1\" != \"--\" ]; do\n\t[ \"$1\" = \"-v\" ] && exit 0\n\tshift\ndone\nshift\nexec \"$@\"\n"
+	require.Nil(t, os.WriteFile(filepath.Join(bin, "sudo"), []byte(sudo), 0o755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	tests := []struct {
+		name string
+		fs   targetFS
+	}{
+		{
+			name: "local",
+			fs:   newTargetFS("", nil),
+		},
+		{
+			name: "sudo",
+			fs:   newTargetFS("root", nil),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			path := filepath.Join(t.TempDir(), "dir", "target")
+
+			require.Nil(t, tt.fs.MkdirAll(ctx, filepath.Dir(path), 0o700))
+
+			exists, err := tt.fs.Exists(ctx, path)
+			require.Nil(t, err)
+			require.False(t, exists)
+
+			content, err := tt.fs.ReadFile(ctx, path)
+			require.Nil(t, err)
+			require.Equal(t, "", content)
+
+			require.Nil(t, tt.fs.WriteFile(ctx, path, "hello\n", 0o600))
+
+			exists, err = tt.fs.Exists(ctx, path)
+			require.Nil(t, err)
+			require.True(t, exists)
+
+			content, err = tt.fs.ReadFile(ctx, path)
+			require.Nil(t, err)
+			require.Equal(t, "hello\n", content)
+
+			info, err := os.Stat(path)
+			require.Nil(t, err)
+			require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+			require.Nil(t, tt.fs.Remove(ctx, path))
+			_, err = os.Stat(path)
+			require.ErrorIs(t, err, os.ErrNotExist)
+		})
+	}
+}
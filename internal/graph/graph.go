@@ -0,0 +1,92 @@
+package graph
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// CycleError is returned when the dependencies contain a cycle.
+type CycleError struct {
+	// the nodes of the cycle, the first and last node are the same
+	Cycle []string
+}
+
+func (e *CycleError) Error() string {
+	return fmt.Sprintf("dependency cycle: %s", strings.Join(e.Cycle, " -> "))
+}
+
+// Sort returns the nodes in topological order, each node comes after its dependencies.
+// The order of nodes which don't depend on each other is kept. Dependencies
+// which aren't part of the nodes are ignored. Returns a *CycleError on cycles.
+func Sort(nodes []string, deps map[string][]string) ([]string, error) {
+	sorted := make([]string, 0, len(nodes))
+	done := make(map[string]bool, len(nodes))
+
+	ready := func(node string) bool {
+		for _, dep := range deps[node] {
+			if slices.Contains(nodes, dep) && !done[dep] {
+				return false
+			}
+		}
+		return true
+	}
+
+	for len(sorted) < len(nodes) {
+		progress := false
+		for _, node := range nodes {
+			if done[node] || !ready(node) {
+				continue
+			}
+			sorted = append(sorted, node)
+			done[node] = true
+			progress = true
+			// start again for keeping the original order as much as possible
+			break
+		}
+		if !progress {
+			return nil, &CycleError{Cycle: findCycle(nodes, deps, done)}
+		}
+	}
+	return sorted, nil
+}
+
+// findCycle returns a cycle within the nodes which are not done yet.
+func findCycle(nodes []string, deps map[string][]string, done map[string]bool) []string {
+	var path []string
+	visited := make(map[string]bool)
+
+	var visit func(node string) []string
+	visit = func(node string) []string {
+		if idx := slices.Index(path, node); idx != -1 {
+			return append(slices.Clone(path[idx:]), node)
+		}
+		if visited[node] {
+			return nil
+		}
+		visited[node] = true
+
+		path = append(path, node)
+		for _, dep := range deps[node] {
+			if !slices.Contains(nodes, dep) || done[dep] {
+				continue
+			}
+			if cycle := visit(dep); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		return nil
+	}
+
+	for _, node := range nodes {
+		if done[node] {
+			continue
+		}
+		if cycle := visit(node); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package graph
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSort(t *testing.T) {
+	tests := []struct {
+		name    string
+		nodes   []string
+		deps    map[string][]string
+		want    []string
+		wantErr string
+	}{
+		{
+			name:  "no deps keeps order",
+			nodes: []string{"c", "a", "b"},
+			want:  []string{"c", "a", "b"},
+		},
+		{
+			name:  "deps",
+			nodes: []string{"vim", "zsh", "base", "homebrew"},
+			deps: map[string][]string{
+				"vim":      {"homebrew"},
+				"zsh":      {"base"},
+				"homebrew": {"base"},
+			},
+			want: []string{"base", "zsh", "homebrew", "vim"},
+		},
+		{
+			name:  "unknown deps are ignored",
+			nodes: []string{"vim"},
+			deps:  map[string][]string{"vim": {"unknown"}},
+			want:  []string{"vim"},
+		},
+		{
+			name:  "cycle",
+			nodes: []string{"base", "a", "b", "c"},
+			deps: map[string][]string{
+				"a": {"b"},
+				"b": {"c"},
+				"c": {"a", "base"},
+			},
+			wantErr: "dependency cycle: a -> b -> c -> a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Sort(tt.nodes, tt.deps)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.Nil(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/sj14/confible/internal/confible"
+)
+
+// Schemer can be implemented by types which can't be described by reflection,
+// e.g. a field which accepts a string or a list of strings.
+type Schemer interface {
+	JSONSchema() map[string]any
+}
+
+var schemerType = reflect.TypeOf((*Schemer)(nil)).Elem()
+
+// Generate returns the JSON schema of the confible file.
+func Generate() ([]byte, error) {
+	schema := object(reflect.TypeOf(confible.File{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "confible"
+	schema["description"] = "Confible configuration file"
+
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+func typeSchema(t reflect.Type) map[string]any {
+	if t.Implements(schemerType) {
+		return reflect.Zero(t).Interface().(Schemer).JSONSchema()
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		return object(t)
+	case reflect.Pointer:
+		return typeSchema(t.Elem())
+	}
+	panic(fmt.Sprintf("unsupported type %v", t))
+}
+
+func object(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	required := []string{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		name := strings.Split(field.Tag.Get("toml"), ",")[0]
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		property := typeSchema(field.Type)
+		if description := field.Tag.Get("description"); description != "" {
+			property["description"] = description
+		}
+		if def, ok := field.Tag.Lookup("default"); ok {
+			property["default"] = defaultValue(field.Type, def)
+		}
+		if field.Tag.Get("required") == "true" {
+			required = append(required, name)
+		}
+		properties[name] = property
+	}
+
+	schema := map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) != 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// defaultValue converts the default tag to the type of the field.
+func defaultValue(t reflect.Type, def string) any {
+	switch t.Kind() {
+	case reflect.Bool:
+		v, err := strconv.ParseBool(def)
+		if err != nil {
+			panic(fmt.Sprintf("invalid default %q: %v", def, err))
+		}
+		return v
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		// base 0 allows octal permissions like 0o644
+		v, err := strconv.ParseInt(def, 0, 64)
+		if err != nil {
+			panic(fmt.Sprintf("invalid default %q: %v", def, err))
+		}
+		return v
+	}
+	return def
+}
@@ -0,0 +1,20 @@
+package schema
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The shipped schema has to be regenerated with 'confible schema > confible.schema.json'
+// whenever the confible file format changes.
+func TestShippedSchema(t *testing.T) {
+	got, err := Generate()
+	require.Nil(t, err)
+
+	shipped, err := os.ReadFile("../../confible.schema.json")
+	require.Nil(t, err)
+
+	require.Equal(t, string(shipped), string(got)+"\n")
+}
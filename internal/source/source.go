@@ -0,0 +1,156 @@
+package source
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Stdin is the path for reading from stdin.
+	Stdin = "-"
+	// GitPrefix is the prefix of paths in a git revision: "git:<rev>:<path>"
+	GitPrefix = "git:"
+)
+
+// ReadFile reads the file at the given path. The path can also be "-" for reading
+// from stdin or "git:<rev>:<path>" for reading the file from a revision of the git
+// repository in the current directory. The git path is relative to the root of the
+// repository, use "./" for paths relative to the current directory.
+func ReadFile(path string) ([]byte, error) {
+	if path == Stdin {
+		content, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading stdin: %v", err)
+		}
+		return content, nil
+	}
+
+	if rev, gitPath, ok := parseGit(path); ok {
+		return git("show", rev+":"+gitPath)
+	}
+
+	return os.ReadFile(path)
+}
+
+// ReadDir returns the names and contents of all files in the directory (not recursive).
+// The directory can also be in a git revision "git:<rev>:<path>" (see ReadFile).
+func ReadDir(dir string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+
+	if rev, gitDir, ok := parseGit(dir); ok {
+		out, err := git("ls-tree", rev+":"+gitDir)
+		if err != nil {
+			return nil, err
+		}
+		// each line: <mode> SP <type> SP <object> TAB <name>
+		for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			meta, name, found := strings.Cut(line, "\t")
+			fields := strings.Fields(meta)
+			// only read blobs (files), not trees (directories)
+			if !found || len(fields) != 3 || fields[1] != "blob" {
+				continue
+			}
+			content, err := git("show", rev+":"+gitDir+"/"+name)
+			if err != nil {
+				return nil, err
+			}
+			files[name] = content
+		}
+		return files, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files[entry.Name()] = content
+	}
+	return files, nil
+}
+
+// Expand replaces directories with the confible files (.toml, .yaml, .yml, .json) they contain.
+// Other paths are returned as they are.
+func Expand(paths []string) ([]string, error) {
+	var expanded []string
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || !info.IsDir() {
+			// stdin, git or a file (errors are reported when reading)
+			expanded = append(expanded, path)
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			switch strings.ToLower(filepath.Ext(entry.Name())) {
+			case ".toml", ".yaml", ".yml", ".json":
+				if !entry.IsDir() {
+					expanded = append(expanded, filepath.Join(path, entry.Name()))
+				}
+			}
+		}
+	}
+	return expanded, nil
+}
+
+// Dir returns the absolute directory of the file at the given path on the file system.
+// Returns the current directory for stdin and git paths, as those files are not checked out.
+// The directory is absolute, so the same file results in the same directory, independent
+// of how its path was given (e.g. for the command cache).
+func Dir(path string) string {
+	dir := filepath.Dir(path)
+	if _, _, ok := parseGit(path); ok || path == Stdin {
+		dir = "."
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return dir
+	}
+	return abs
+}
+
+// parseGit splits "git:<rev>:<path>" into the revision and the path.
+func parseGit(path string) (rev, gitPath string, ok bool) {
+	if !strings.HasPrefix(path, GitPrefix) {
+		return "", "", false
+	}
+	rev, gitPath, ok = strings.Cut(strings.TrimPrefix(path, GitPrefix), ":")
+	if !ok || rev == "" || gitPath == "" {
+		return "", "", false
+	}
+	return rev, filepath.ToSlash(gitPath), true
+}
+
+// git runs the git command with the object (e.g. "<rev>:<path>"), which
+// is never parsed as an option, even when it starts with '-'.
+func git(cmd, object string) ([]byte, error) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+
+	args := []string{cmd, "--end-of-options", object}
+	c := exec.Command("git", args...)
+	c.Stdout = stdout
+	c.Stderr = stderr
+
+	if err := c.Run(); err != nil {
+		return nil, fmt.Errorf("failed running 'git %s': %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,100 @@
+package source
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGit(t *testing.T) {
+	tests := []struct {
+		path    string
+		wantRev string
+		want    string
+		wantOk  bool
+	}{
+		{path: "git:v1.0:dotfiles/vim.toml", wantRev: "v1.0", want: "dotfiles/vim.toml", wantOk: true},
+		{path: "git:HEAD~1:./vim.toml", wantRev: "HEAD~1", want: "./vim.toml", wantOk: true},
+		{path: "git:v1.0", wantOk: false},
+		{path: "git::vim.toml", wantOk: false},
+		{path: "vim.toml", wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rev, path, ok := parseGit(tt.path)
+			require.Equal(t, tt.wantOk, ok)
+			require.Equal(t, tt.wantRev, rev)
+			require.Equal(t, tt.want, path)
+		})
+	}
+}
+
+func TestReadGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir := t.TempDir()
+	run := func(args ...string) {
+		c := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		c.Dir = dir
+		out, err := c.CombinedOutput()
+		require.Nil(t, err, string(out))
+	}
+
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "templates", "nested"), 0o700))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "vim.toml"), []byte("v1"), 0o600))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "templates", "proxy.tmpl"), []byte("proxy"), 0o600))
+	run("init", "-q")
+	run("add", "-A")
+	run("commit", "-q", "-m", "init")
+	run("tag", "v1")
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "vim.toml"), []byte("v2"), 0o600))
+
+	wd, err := os.Getwd()
+	require.Nil(t, err)
+	require.Nil(t, os.Chdir(dir))
+	defer func() { require.Nil(t, os.Chdir(wd)) }()
+
+	content, err := ReadFile("git:v1:vim.toml")
+	require.Nil(t, err)
+	require.Equal(t, "v1", string(content))
+
+	files, err := ReadDir("git:v1:templates")
+	require.Nil(t, err)
+	require.Equal(t, map[string][]byte{"proxy.tmpl": []byte("proxy")}, files)
+
+	_, err = ReadFile("git:v2:vim.toml")
+	require.NotNil(t, err)
+
+	// not an option of git show, which would write to "<output>:vim.toml"
+	output := filepath.Join(dir, "output")
+	_, err = ReadFile("git:--output=" + output + ":vim.toml")
+	require.NotNil(t, err)
+	require.NoFileExists(t, output+":vim.toml")
+}
+
+func TestDir(t *testing.T) {
+	wd, err := os.Getwd()
+	require.Nil(t, err)
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "vim.toml", want: wd},
+		{path: "dots/vim.toml", want: filepath.Join(wd, "dots")},
+		{path: "./dots/../dots/vim.toml", want: filepath.Join(wd, "dots")},
+		{path: filepath.Join(wd, "dots", "vim.toml"), want: filepath.Join(wd, "dots")},
+		{path: Stdin, want: wd},
+		{path: "git:HEAD:dots/vim.toml", want: wd},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			require.Equal(t, tt.want, Dir(tt.path))
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package template
+
+import (
+	"fmt"
+	"text/template"
+	"text/template/parse"
+)
+
+// VarRef is a reference to a variable ({{ .Var.name }}) in a template.
+type VarRef struct {
+	Name string
+	// location within the template, e.g. "append:3:5"
+	Location string
+}
+
+// Check parses the text and the snippets without executing them and returns
+// the references to variables of the text (but not of the included snippets).
+func Check(name, text string, snippets map[string]string) ([]VarRef, error) {
+	templ := template.New(name).Funcs(funcMap(Data{}))
+
+	for snippetName, snippet := range snippets {
+		if _, err := templ.New(snippetName).Parse(snippet); err != nil {
+			return nil, fmt.Errorf("failed parsing snippet %q: %v", snippetName, err)
+		}
+	}
+
+	templ, err := templ.Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	if templ.Tree == nil {
+		return nil, nil
+	}
+	return varRefs(templ.Tree, templ.Tree.Root), nil
+}
+
+func varRefs(tree *parse.Tree, node parse.Node) []VarRef {
+	var refs []VarRef
+
+	ref := func(ident []string) {
+		if len(ident) >= 2 && ident[0] == "Var" {
+			location, _ := tree.ErrorContext(node)
+			refs = append(refs, VarRef{Name: ident[1], Location: location})
+		}
+	}
+
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			refs = append(refs, varRefs(tree, child)...)
+		}
+	case *parse.ActionNode:
+		refs = append(refs, varRefs(tree, n.Pipe)...)
+	case *parse.PipeNode:
+		if n == nil {
+			return nil
+		}
+		for _, cmd := range n.Cmds {
+			refs = append(refs, varRefs(tree, cmd)...)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			refs = append(refs, varRefs(tree, arg)...)
+		}
+	case *parse.ChainNode:
+		refs = append(refs, varRefs(tree, n.Node)...)
+	case *parse.FieldNode:
+		ref(n.Ident)
+	case *parse.VariableNode:
+		// $.Var.name
+		if len(n.Ident) > 0 && n.Ident[0] == "$" {
+			ref(n.Ident[1:])
+		}
+	case *parse.IfNode:
+		refs = append(refs, branchVarRefs(tree, &n.BranchNode)...)
+	case *parse.RangeNode:
+		refs = append(refs, branchVarRefs(tree, &n.BranchNode)...)
+	case *parse.WithNode:
+		refs = append(refs, branchVarRefs(tree, &n.BranchNode)...)
+	case *parse.TemplateNode:
+		refs = append(refs, varRefs(tree, n.Pipe)...)
+	}
+	return refs
+}
+
+func branchVarRefs(tree *parse.Tree, n *parse.BranchNode) []VarRef {
+	refs := varRefs(tree, n.Pipe)
+	refs = append(refs, varRefs(tree, n.List)...)
+	return append(refs, varRefs(tree, n.ElseList)...)
+}
@@ -0,0 +1,69 @@
+package template
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"os/user"
+	"runtime"
+	"strings"
+)
+
+// Host contains facts about the machine and the target user.
+type Host struct {
+	Hostname string
+	OS       string
+	Arch     string
+	Username string
+	UID      string
+	Home     string
+	CPUs     int
+	// The ID from /etc/os-release (e.g. "debian", "ubuntu", "arch"), empty when unknown.
+	Distro string
+}
+
+func hostFacts(usr *user.User) Host {
+	host := Host{
+		OS:     runtime.GOOS,
+		Arch:   runtime.GOARCH,
+		CPUs:   runtime.NumCPU(),
+		Distro: distro("/etc/os-release"),
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Printf("failed getting hostname: %v\n", err)
+	}
+	host.Hostname = hostname
+
+	if usr == nil {
+		usr, err = user.Current()
+		if err != nil {
+			log.Printf("failed getting current user: %v\n", err)
+			return host
+		}
+	}
+	host.Username = usr.Username
+	host.UID = usr.Uid
+	host.Home = usr.HomeDir
+
+	return host
+}
+
+// distro returns the ID of the os-release file.
+func distro(osReleasePath string) string {
+	f, err := os.Open(osReleasePath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), "=")
+		if found && key == "ID" {
+			return strings.Trim(value, `"'`)
+		}
+	}
+	return ""
+}
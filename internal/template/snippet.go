@@ -0,0 +1,44 @@
+package template
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/sj14/confible/internal/confible"
+	"github.com/sj14/confible/internal/source"
+)
+
+// LoadSnippets reads the snippets from the given directory (see source.ReadDir)
+// and adds the snippets defined in the confible file. The name of a snippet from the directory is the
+// file name without extension, e.g. "proxy" for "templates/proxy.tmpl".
+func LoadSnippets(dir string, defined []confible.Snippet) (map[string]string, error) {
+	snippets := make(map[string]string)
+
+	if dir != "" {
+		files, err := source.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading templates directory: %v", err)
+		}
+
+		for fileName, content := range files {
+			name := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+			if _, ok := snippets[name]; ok {
+				return nil, fmt.Errorf("multiple templates named %q in %q", name, dir)
+			}
+			snippets[name] = strings.TrimSpace(string(content))
+		}
+	}
+
+	for _, snippet := range defined {
+		if snippet.Name == "" {
+			return nil, fmt.Errorf("missing snippet name")
+		}
+		if _, ok := snippets[snippet.Name]; ok {
+			return nil, fmt.Errorf("snippet %q is defined multiple times", snippet.Name)
+		}
+		snippets[snippet.Name] = strings.TrimSpace(snippet.Text)
+	}
+
+	return snippets, nil
+}
@@ -0,0 +1,170 @@
+package template
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/sj14/confible/internal/utils"
+)
+
+// Data is passed to the templates.
+type Data struct {
+	Env  map[string]string
+	Var  map[string]string
+	Host Host
+
+	// the target user for the directory functions, nil for the current user
+	user *user.User
+	// named templates which can be used with {{ template "name" . }}
+	snippets map[string]string
+	// fail on missing keys instead of rendering an empty value
+	strict bool
+}
+
+// NewData returns the template data with the environment, the given variables
+// and the host facts. The user related facts and functions refer to usr or to
+// the current user when usr is nil.
+func NewData(vars map[string]string, usr *user.User) Data {
+	return Data{
+		Env:  utils.GetEnvMap(),
+		Var:  vars,
+		Host: hostFacts(usr),
+		user: usr,
+	}
+}
+
+// WithSnippets returns a copy of the data where the snippets can be
+// included in the rendered text with {{ template "name" . }}.
+func (d Data) WithSnippets(snippets map[string]string) Data {
+	d.snippets = snippets
+	return d
+}
+
+// WithStrict returns a copy of the data where rendering fails
+// when a key of .Var or .Env is missing.
+func (d Data) WithStrict(strict bool) Data {
+	d.strict = strict
+	return d
+}
+
+// Render executes the text as template with the given data.
+// The name is part of the error messages, which contain the line
+// and column within the text, e.g. "template: append:3:5: ...".
+func Render(name, text string, data Data) (string, error) {
+	templ := template.New(name).Funcs(funcMap(data))
+	if data.strict {
+		templ = templ.Option("missingkey=error")
+	}
+
+	for snippetName, snippet := range data.snippets {
+		if _, err := templ.New(snippetName).Parse(snippet); err != nil {
+			return "", fmt.Errorf("failed parsing snippet %q: %v", snippetName, err)
+		}
+	}
+
+	templ, err := templ.Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	result := strings.Builder{}
+	if err := templ.Execute(&result, data); err != nil {
+		return "", err
+	}
+	return result.String(), nil
+}
+
+// The argument order of the functions allows piping the last argument,
+// e.g. {{ .Env.EDITOR | default "vim" }} or {{ .Var.name | replace " " "_" }}.
+func funcMap(data Data) template.FuncMap {
+	return template.FuncMap{
+		"default":      defaultValue,
+		"upper":        strings.ToUpper,
+		"lower":        strings.ToLower,
+		"trim":         strings.TrimSpace,
+		"join":         func(sep string, elems []string) string { return strings.Join(elems, sep) },
+		"split":        func(sep, s string) []string { return strings.Split(s, sep) },
+		"contains":     func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":    func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":    func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"replace":      func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"regexReplace": regexReplace,
+		"indent":       indent,
+		"quote":        func(s string) string { return fmt.Sprintf("%q", s) },
+		"shellquote":   shellQuote,
+		"toJson":       toJSON,
+		"env":          os.Getenv,
+		"fileExists":   func(path string) (bool, error) { return fileExists(path, data.user) },
+		"sha256":       sha256sum,
+		"configDir":    func() (string, error) { return utils.ConfigDir(data.user) },
+		"cacheDir":     func() (string, error) { return utils.CacheDir(data.user) },
+		"dataDir":      func() (string, error) { return utils.DataDir(data.user) },
+		"stateDir":     func() (string, error) { return utils.StateDir(data.user) },
+		"runtimeDir":   func() (string, error) { return utils.RuntimeDir(data.user) },
+	}
+}
+
+// defaultValue returns value or def when value is empty or missing.
+func defaultValue(def string, value any) string {
+	if value == nil || fmt.Sprint(value) == "" {
+		return def
+	}
+	return fmt.Sprint(value)
+}
+
+// shellQuote quotes s as a single argument for POSIX shells.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func regexReplace(expr, repl, s string) (string, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return "", err
+	}
+	return re.ReplaceAllString(s, repl), nil
+}
+
+// indent adds the given number of spaces in front of each non-empty line.
+func indent(spaces int, s string) string {
+	pad := strings.Repeat(" ", spaces)
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = pad + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func toJSON(v any) (string, error) {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+func fileExists(path string, usr *user.User) (bool, error) {
+	path, err := utils.AbsFilepath(path, usr)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	return err == nil, nil
+}
+
+func sha256sum(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
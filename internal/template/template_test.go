@@ -0,0 +1,84 @@
+package template
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sj14/confible/internal/confible"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRender(t *testing.T) {
+	data := Data{
+		Env:  map[string]string{"EDITOR": "nvim"},
+		Var:  map[string]string{"name": "Jane Doe", "list": "a,b,c", "nick": "it's me"},
+		Host: Host{OS: "linux", Distro: "debian"},
+	}
+
+	tests := []struct {
+		name    string
+		text    string
+		want    string
+		wantErr bool
+	}{
+		{name: "default set", text: `{{ .Env.EDITOR | default "vim" }}`, want: "nvim"},
+		{name: "default missing", text: `{{ .Env.VISUAL | default "vim" }}`, want: "vim"},
+		{name: "upper", text: `{{ .Var.name | upper }}`, want: "JANE DOE"},
+		{name: "lower", text: `{{ .Var.name | lower }}`, want: "jane doe"},
+		{name: "trim", text: `{{ "  x  " | trim }}`, want: "x"},
+		{name: "split join", text: `{{ .Var.list | split "," | join ";" }}`, want: "a;b;c"},
+		{name: "contains", text: `{{ if .Var.name | contains "Doe" }}yes{{ end }}`, want: "yes"},
+		{name: "replace", text: `{{ .Var.name | replace " " "_" }}`, want: "Jane_Doe"},
+		{name: "regexReplace", text: `{{ .Var.name | regexReplace "[aeiou]" "" }}`, want: "Jn D"},
+		{name: "regexReplace invalid", text: `{{ .Var.name | regexReplace "(" "" }}`, wantErr: true},
+		{name: "indent", text: `{{ "a\n\nb" | indent 2 }}`, want: "  a\n\n  b"},
+		{name: "quote", text: `{{ .Var.name | quote }}`, want: `"Jane Doe"`},
+		{name: "shellquote", text: `{{ .Var.name | shellquote }}`, want: `'Jane Doe'`},
+		{name: "shellquote single quote", text: `{{ .Var.nick | shellquote }}`, want: `'it'\''s me'`},
+		{name: "toJson", text: `{{ .Var | toJson }}`, want: `{"list":"a,b,c","name":"Jane Doe","nick":"it's me"}`},
+		{name: "sha256", text: `{{ "hello" | sha256 }}`, want: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"},
+		{name: "host", text: `{{ if eq .Host.Distro "debian" }}apt{{ end }}`, want: "apt"},
+		{name: "fileExists", text: `{{ fileExists "/this/does/not/exist" }}`, want: "false"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Render(tt.name, tt.text, data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Render() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestDistro(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "os-release")
+	err := os.WriteFile(path, []byte("NAME=\"Ubuntu\"\nID=ubuntu\nID_LIKE=debian\n"), 0o644)
+	require.Nil(t, err)
+
+	require.Equal(t, "ubuntu", distro(path))
+	require.Equal(t, "", distro(filepath.Join(t.TempDir(), "missing")))
+}
+
+func TestRenderSnippets(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "proxy.tmpl"), []byte("export http_proxy={{ .Var.proxy }}\n"), 0o644)
+	require.Nil(t, err)
+
+	snippets, err := LoadSnippets(dir, []confible.Snippet{
+		{Name: "path", Text: `export PATH="$HOME/bin:$PATH"`},
+		{Name: "all", Text: `{{ template "proxy" . }}` + "\n" + `{{ template "path" . }}`},
+	})
+	require.Nil(t, err)
+
+	data := Data{Var: map[string]string{"proxy": "http://proxy:3128"}}.WithSnippets(snippets)
+
+	got, err := Render("test", `{{ template "all" . }}`, data)
+	require.Nil(t, err)
+	require.Equal(t, "export http_proxy=http://proxy:3128\nexport PATH=\"$HOME/bin:$PATH\"", got)
+
+	_, err = LoadSnippets(dir, []confible.Snippet{{Name: "proxy", Text: "duplicate"}})
+	require.NotNil(t, err)
+}
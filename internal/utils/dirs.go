@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+)
+
+// The directory functions return the standard directories of the given user
+// or the current user when usr is nil. On Linux and other unix systems, they follow
+// the XDG Base Directory Specification. The XDG environment variables are only
+// respected for the current user, as they belong to the environment of the current user.
+// On macOS and Windows, the platform conventions are used (see os.UserConfigDir).
+
+// ConfigDir returns the directory for user-specific configuration files.
+func ConfigDir(usr *user.User) (string, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return homeJoin(usr, "Library", "Application Support")
+	case "windows":
+		return windowsDir(usr, "AppData", "Roaming")
+	}
+	return xdgDir(usr, "XDG_CONFIG_HOME", ".config")
+}
+
+// CacheDir returns the directory for user-specific cached data.
+func CacheDir(usr *user.User) (string, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return homeJoin(usr, "Library", "Caches")
+	case "windows":
+		return windowsDir(usr, "LocalAppData", "Local")
+	}
+	return xdgDir(usr, "XDG_CACHE_HOME", ".cache")
+}
+
+// DataDir returns the directory for user-specific data files.
+func DataDir(usr *user.User) (string, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return homeJoin(usr, "Library", "Application Support")
+	case "windows":
+		return windowsDir(usr, "LocalAppData", "Local")
+	}
+	return xdgDir(usr, "XDG_DATA_HOME", filepath.Join(".local", "share"))
+}
+
+// StateDir returns the directory for user-specific state files (e.g. history or logs).
+func StateDir(usr *user.User) (string, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return homeJoin(usr, "Library", "Application Support")
+	case "windows":
+		return windowsDir(usr, "LocalAppData", "Local")
+	}
+	return xdgDir(usr, "XDG_STATE_HOME", filepath.Join(".local", "state"))
+}
+
+// RuntimeDir returns the directory for user-specific runtime files (e.g. sockets).
+func RuntimeDir(usr *user.User) (string, error) {
+	switch runtime.GOOS {
+	case "darwin", "windows":
+		return os.TempDir(), nil
+	}
+
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); usr == nil && filepath.IsAbs(dir) {
+		return dir, nil
+	}
+
+	if usr != nil {
+		return filepath.Join("/run/user", usr.Uid), nil
+	}
+	return filepath.Join("/run/user", strconv.Itoa(os.Getuid())), nil
+}
+
+func xdgDir(usr *user.User, env, fallback string) (string, error) {
+	// relative paths are invalid according to the specification and have to be ignored
+	if dir := os.Getenv(env); usr == nil && filepath.IsAbs(dir) {
+		return dir, nil
+	}
+	return homeJoin(usr, fallback)
+}
+
+func windowsDir(usr *user.User, env, fallback string) (string, error) {
+	if dir := os.Getenv(env); usr == nil && dir != "" {
+		return dir, nil
+	}
+	return homeJoin(usr, "AppData", fallback)
+}
+
+func homeJoin(usr *user.User, elem ...string) (string, error) {
+	home, err := homeDir(usr)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(append([]string{home}, elem...)...), nil
+}
@@ -1,23 +1,127 @@
 package utils
 
 import (
-	"log"
+	"errors"
+	"fmt"
 	"os"
+	"os/user"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 )
 
-func AbsFilepath(path string) string {
+// LookupUser returns the user with the given name from the passwd database.
+// It returns nil when no name is given, which means the current user is used.
+func LookupUser(name string) (*user.User, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	usr, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed looking up user %q: %v", name, err)
+	}
+	return usr, nil
+}
+
+// AbsFilepath expands environment variables ($VAR and ${VAR}) and a leading '~' or '~username'
+// to the corresponding home directory. When usr is given, '~', $HOME, $USER and $LOGNAME
+// refer to this user instead of the current user. Returns an error when the home directory
+// of the user can't be looked up.
+func AbsFilepath(path string, usr *user.User) (string, error) {
+	path = os.Expand(path, func(key string) string {
+		if usr != nil {
+			switch key {
+			case "HOME":
+				return usr.HomeDir
+			case "USER", "LOGNAME":
+				return usr.Username
+			}
+		}
+		return os.Getenv(key)
+	})
+
 	if !strings.HasPrefix(path, "~") {
-		return path
+		return path, nil
+	}
+
+	// split "~username/rest" into "username" and "/rest"
+	name, rest := path[1:], ""
+	if idx := strings.IndexAny(name, `/\`); idx != -1 {
+		name, rest = name[:idx], name[idx:]
+	}
+
+	if name != "" {
+		var err error
+		usr, err = LookupUser(name)
+		if err != nil {
+			return "", fmt.Errorf("failed expanding %q: %v", path, err)
+		}
 	}
 
-	home, err := os.UserHomeDir()
+	home, err := homeDir(usr)
 	if err != nil {
-		log.Fatalf("failed getting home dir: %v\n", err)
+		return "", fmt.Errorf("failed expanding %q: failed getting home dir: %v", path, err)
+	}
+
+	return filepath.Join(home, rest), nil
+}
+
+func homeDir(usr *user.User) (string, error) {
+	if usr != nil {
+		return usr.HomeDir, nil
 	}
+	return os.UserHomeDir()
+}
 
-	return filepath.Join(home, path[1:])
+// MkdirAll creates the directory like os.MkdirAll but changes the owner
+// of all newly created directories to the given user.
+func MkdirAll(dir string, perm os.FileMode, usr *user.User) error {
+	// find the directories which don't exist yet
+	var created []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		created = append(created, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+
+	if err := os.MkdirAll(dir, perm); err != nil {
+		return err
+	}
+
+	for _, d := range created {
+		if err := Chown(d, usr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Chown changes the owner of the file to the given user.
+// Nothing is changed when usr is nil or on Windows.
+func Chown(path string, usr *user.User) error {
+	if usr == nil || runtime.GOOS == "windows" {
+		return nil
+	}
+
+	uid, err := strconv.Atoi(usr.Uid)
+	if err != nil {
+		return fmt.Errorf("invalid uid %q of user %q: %v", usr.Uid, usr.Username, err)
+	}
+	gid, err := strconv.Atoi(usr.Gid)
+	if err != nil {
+		return fmt.Errorf("invalid gid %q of user %q: %v", usr.Gid, usr.Username, err)
+	}
+
+	if err := os.Chown(path, uid, gid); err != nil {
+		return fmt.Errorf("failed changing owner of %q to %q: %v", path, usr.Username, err)
+	}
+	return nil
 }
 
 func GetEnvMap() map[string]string {
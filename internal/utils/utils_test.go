@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAbsFilepath(t *testing.T) {
+	home, err := os.UserHomeDir()
+	require.Nil(t, err)
+
+	require.Nil(t, os.Setenv("CONFIBLE_TEST_DIR", "/tmp/confible"))
+
+	alice := &user.User{Username: "alice", HomeDir: "/home/alice"}
+
+	tests := []struct {
+		name    string
+		path    string
+		usr     *user.User
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "absolute",
+			path: "/etc/hosts",
+			want: "/etc/hosts",
+		},
+		{
+			name: "tilde",
+			path: "~/.vimrc",
+			want: filepath.Join(home, ".vimrc"),
+		},
+		{
+			name: "tilde other user",
+			path: "~/.vimrc",
+			usr:  alice,
+			want: "/home/alice/.vimrc",
+		},
+		{
+			name: "env",
+			path: "$CONFIBLE_TEST_DIR/config",
+			want: "/tmp/confible/config",
+		},
+		{
+			name: "env braces",
+			path: "${CONFIBLE_TEST_DIR}/config",
+			want: "/tmp/confible/config",
+		},
+		{
+			name: "home env other user",
+			path: "${HOME}/.config",
+			usr:  alice,
+			want: "/home/alice/.config",
+		},
+		{
+			name:    "unknown user",
+			path:    "~confible-unknown-user/.vimrc",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AbsFilepath(tt.path, tt.usr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("AbsFilepath() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestXDGDirs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("XDG directories are only used on linux")
+	}
+
+	t.Setenv("XDG_CONFIG_HOME", "/tmp/xdg/config")
+	t.Setenv("XDG_CACHE_HOME", "relative/paths/are/ignored")
+	t.Setenv("HOME", "/home/me")
+
+	alice := &user.User{Username: "alice", Uid: "1001", HomeDir: "/home/alice"}
+
+	tests := []struct {
+		name string
+		fn   func(*user.User) (string, error)
+		usr  *user.User
+		want string
+	}{
+		{name: "config from env", fn: ConfigDir, want: "/tmp/xdg/config"},
+		{name: "config other user", fn: ConfigDir, usr: alice, want: "/home/alice/.config"},
+		{name: "cache relative env", fn: CacheDir, want: "/home/me/.cache"},
+		{name: "data", fn: DataDir, usr: alice, want: "/home/alice/.local/share"},
+		{name: "state", fn: StateDir, usr: alice, want: "/home/alice/.local/state"},
+		{name: "runtime", fn: RuntimeDir, usr: alice, want: "/run/user/1001"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.fn(tt.usr)
+			require.Nil(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
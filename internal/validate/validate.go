@@ -0,0 +1,364 @@
+package validate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pelletier/go-toml/v2/unstable"
+	"github.com/sj14/confible/internal/confible"
+	"github.com/sj14/confible/internal/config"
+	"github.com/sj14/confible/internal/source"
+	"github.com/sj14/confible/internal/template"
+	"github.com/sj14/confible/internal/utils"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// possible values of $GOOS and $GOARCH (go tool dist list)
+var (
+	knownOSs = []string{
+		"aix", "android", "darwin", "dragonfly", "freebsd", "illumos", "ios", "js",
+		"linux", "netbsd", "openbsd", "plan9", "solaris", "wasip1", "windows",
+	}
+	knownArchs = []string{
+		"386", "amd64", "arm", "arm64", "loong64", "mips", "mips64", "mips64le",
+		"mipsle", "ppc64", "ppc64le", "riscv64", "s390x", "wasm",
+	}
+)
+
+// Problem is a single issue of a confible file.
+type Problem struct {
+	Path string
+	// Line and Column are 0 when the position is unknown.
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (p Problem) String() string {
+	switch {
+	case p.Line != 0 && p.Column != 0:
+		return fmt.Sprintf("%s:%d:%d: %s", p.Path, p.Line, p.Column, p.Msg)
+	case p.Line != 0:
+		return fmt.Sprintf("%s:%d: %s", p.Path, p.Line, p.Msg)
+	}
+	return fmt.Sprintf("%s: %s", p.Path, p.Msg)
+}
+
+// Files validates the confible files and returns all found problems. Directories
+// are replaced with the confible files they contain. The format is detected by
+// the file extension when it's empty.
+func Files(paths []string, format confible.Format) []Problem {
+	var problems []Problem
+
+	// key == id; value == path of the first file with this id
+	ids := make(map[string]string)
+
+	var expanded []string
+	for _, path := range paths {
+		files, err := source.Expand([]string{path})
+		if err != nil {
+			problems = append(problems, Problem{Path: path, Msg: err.Error()})
+			continue
+		}
+		expanded = append(expanded, files...)
+	}
+
+	for _, path := range expanded {
+		content, err := source.ReadFile(path)
+		if err != nil {
+			problems = append(problems, Problem{Path: path, Msg: err.Error()})
+			continue
+		}
+
+		fileFormat := format
+		if fileFormat == "" {
+			fileFormat = confible.FormatFromPath(path)
+		}
+
+		file, fileProblems := validate(path, content, fileFormat)
+		problems = append(problems, fileProblems...)
+
+		if file.Settings.ID == "" {
+			continue
+		}
+		if other, ok := ids[file.Settings.ID]; ok {
+			line := 0
+			if fileFormat == confible.FormatTOML {
+				line = tableLine(content, "settings")
+			}
+			problems = append(problems, Problem{Path: path, Line: line, Msg: fmt.Sprintf("id %q is already used by %q", file.Settings.ID, other)})
+			continue
+		}
+		ids[file.Settings.ID] = path
+	}
+
+	return problems
+}
+
+func validate(path string, content []byte, format confible.Format) (confible.File, []Problem) {
+	var problems []Problem
+	add := func(line int, msg string, args ...any) {
+		problems = append(problems, Problem{Path: path, Line: line, Msg: fmt.Sprintf(msg, args...)})
+	}
+
+	file, err := confible.Decode(bytes.NewReader(content), format)
+	var (
+		strictErr *toml.StrictMissingError
+		decodeErr *toml.DecodeError
+	)
+	switch {
+	case errors.As(err, &strictErr):
+		// the file was decoded, report the unknown fields and continue
+		for _, e := range strictErr.Errors {
+			line, column := e.Position()
+			problems = append(problems, Problem{Path: path, Line: line, Column: column, Msg: fmt.Sprintf("unknown field %q", strings.Join(e.Key(), "."))})
+		}
+	case errors.As(err, &decodeErr):
+		line, column := decodeErr.Position()
+		return file, append(problems, Problem{Path: path, Line: line, Column: column, Msg: decodeErr.Error()})
+	case err != nil:
+		return file, append(problems, Problem{Path: path, Msg: err.Error()})
+	}
+
+	// the lines are only known for TOML files
+	lines := make(tableLines)
+	settingsLine := 0
+	if format == confible.FormatTOML {
+		lines = arrayTableLines(content)
+		settingsLine = tableLine(content, "settings")
+	}
+
+	if file.Settings.ID == "" {
+		add(settingsLine, "missing id")
+	}
+	checkFilter(settingsLine, "settings", file.Settings.OSs, file.Settings.Archs, add)
+
+	// all defined variables
+	var vars []string
+	for i, variables := range file.Variables {
+		line := lines.get("variables", i)
+		checkFilter(line, "[[variables]]", variables.OSs, variables.Archs, add)
+		for _, input := range variables.Input {
+			if input.VariableName == "" {
+				add(line, "[[variables]] #%d: missing variable name of input", i+1)
+			}
+			vars = append(vars, input.VariableName)
+		}
+		for _, cmd := range variables.Exec {
+			if cmd.VariableName == "" {
+				add(line, "[[variables]] #%d: missing variable name of exec", i+1)
+			}
+			vars = append(vars, cmd.VariableName)
+		}
+	}
+
+	for i, command := range file.Commands {
+		checkFilter(lines.get("commands", i), "[[commands]]", command.OSs, command.Archs, add)
+	}
+
+	templatesDir, err := file.Settings.TemplatesDir(path)
+	if err != nil {
+		add(settingsLine, "settings: %v", err)
+	}
+	snippets, err := template.LoadSnippets(templatesDir, file.Snippets)
+	if err != nil {
+		add(lines.get("snippet", 0), "%v", err)
+	}
+
+	// check the text for template syntax errors and undefined variables
+	checkTemplate := func(line int, pos, name, text string) {
+		refs, err := template.Check(name, text, snippets)
+		if err != nil {
+			add(line, "%s: %v", pos, err)
+			return
+		}
+		for _, ref := range refs {
+			if !slices.Contains(vars, ref.Name) {
+				add(line, "%s: %s: undefined variable %q", pos, ref.Location, ref.Name)
+			}
+		}
+	}
+
+	names := maps.Keys(snippets)
+	slices.Sort(names)
+	for _, name := range names {
+		// snippets from the templates directory don't have a line
+		line := 0
+		for i, snippet := range file.Snippets {
+			if snippet.Name == name {
+				line = lines.get("snippet", i)
+			}
+		}
+		checkTemplate(line, fmt.Sprintf("snippet %q", name), name, snippets[name])
+	}
+
+	for i, variables := range file.Variables {
+		for _, cmd := range variables.Exec {
+			checkTemplate(lines.get("variables", i), fmt.Sprintf("[[variables]] #%d", i+1), "exec", cmd.Cmd)
+		}
+	}
+
+	// key == target path
+	targets := make(map[string]confible.Config)
+
+	for i, cfg := range file.Configs {
+		line := lines.get("config", i)
+		pos := fmt.Sprintf("[[config]] #%d", i+1)
+
+		for _, err := range config.CheckConfig(cfg) {
+			add(line, "%s: %v", pos, err)
+		}
+		checkFilter(line, pos, cfg.OSs, cfg.Archs, add)
+
+		checkTemplate(line, pos, "path", cfg.Path)
+		checkTemplate(line, pos, "append", cfg.Append)
+
+		// templated paths can't be compared without rendering them
+		target, err := utils.AbsFilepath(cfg.Path, nil)
+		if err != nil {
+			// e.g. '~{{ .Var.user }}' is only known when rendered
+			if !strings.Contains(cfg.Path, "{{") {
+				add(line, "%s: %v", pos, err)
+			}
+			continue
+		}
+		if old, ok := targets[target]; ok {
+			for _, err := range config.CheckConflicts(old, cfg) {
+				add(line, "%s: %v", pos, err)
+			}
+			continue
+		}
+		targets[target] = cfg
+	}
+
+	// key == name of the commands; value == commands with this name
+	commandNames := make(map[string][]confible.Command)
+	for _, command := range file.Commands {
+		if command.Name == "" {
+			continue
+		}
+		commandNames[command.Name] = append(commandNames[command.Name], command)
+	}
+
+	for i, command := range file.Commands {
+		for _, need := range command.Needs {
+			needed := commandNames[need]
+			switch {
+			case len(needed) == 0:
+				add(lines.get("commands", i), "[[commands]] #%d: needs unknown commands %q", i+1, need)
+			case len(command.OnChange) == 0 && !slices.ContainsFunc(needed, func(c confible.Command) bool { return len(c.OnChange) == 0 }):
+				add(lines.get("commands", i), "[[commands]] #%d: needs %q, which only runs on changes", i+1, need)
+			case len(command.OnChange) == 0 && !command.AfterConfigs && !slices.ContainsFunc(needed, func(c confible.Command) bool { return !c.AfterConfigs }):
+				add(lines.get("commands", i), "[[commands]] #%d: needs %q, which runs after the configs", i+1, need)
+			}
+		}
+		for _, ref := range command.OnChange {
+			if !referencesConfig(file.Configs, ref) {
+				add(lines.get("commands", i), "[[commands]] #%d: on_change references unknown config %q", i+1, ref)
+			}
+		}
+		if command.AsUser && command.BecomeUser() != "" {
+			add(lines.get("commands", i), "[[commands]] #%d: as_user can't be combined with sudo or become", i+1)
+		}
+		if command.Interpreter != "" && command.Script == "" {
+			add(lines.get("commands", i), "[[commands]] #%d: interpreter without script", i+1)
+		}
+		checkTemplate(lines.get("commands", i), fmt.Sprintf("[[commands]] #%d", i+1), "stdin", command.Stdin)
+		for _, cmd := range command.Exec {
+			checkTemplate(lines.get("commands", i), fmt.Sprintf("[[commands]] #%d", i+1), "exec", cmd)
+		}
+		checkTemplate(lines.get("commands", i), fmt.Sprintf("[[commands]] #%d", i+1), "script", command.Script)
+		checkTemplate(lines.get("commands", i), fmt.Sprintf("[[commands]] #%d", i+1), "creates", command.Creates)
+		checkTemplate(lines.get("commands", i), fmt.Sprintf("[[commands]] #%d", i+1), "unless", command.Unless)
+		checkTemplate(lines.get("commands", i), fmt.Sprintf("[[commands]] #%d", i+1), "onlyif", command.OnlyIf)
+	}
+
+	return file, problems
+}
+
+// referencesConfig returns if the reference is the name or path of one of the configs.
+func referencesConfig(configs []confible.Config, ref string) bool {
+	for _, cfg := range configs {
+		if cfg.Name == ref || cfg.Path == ref {
+			return true
+		}
+		path, err := utils.AbsFilepath(cfg.Path, nil)
+		if err != nil {
+			continue
+		}
+		if refPath, err := utils.AbsFilepath(ref, nil); err == nil && path == refPath {
+			return true
+		}
+	}
+	return false
+}
+
+func checkFilter(line int, pos string, oss, archs []string, add func(int, string, ...any)) {
+	for _, goos := range oss {
+		if !slices.Contains(knownOSs, goos) {
+			add(line, "%s: unknown os %q", pos, goos)
+		}
+	}
+	for _, arch := range archs {
+		if !slices.Contains(knownArchs, arch) {
+			add(line, "%s: unknown arch %q", pos, arch)
+		}
+	}
+}
+
+// key == table name; value == lines of the array tables in order of appearance
+type tableLines map[string][]int
+
+// get returns the line of the nth array table or 0 when unknown.
+func (t tableLines) get(name string, n int) int {
+	if n < len(t[name]) {
+		return t[name][n]
+	}
+	return 0
+}
+
+// arrayTableLines returns the lines of all top-level array tables, e.g. [[config]].
+func arrayTableLines(content []byte) tableLines {
+	lines := make(tableLines)
+
+	p := unstable.Parser{}
+	p.Reset(content)
+	for p.NextExpression() {
+		expr := p.Expression()
+		if expr.Kind != unstable.ArrayTable {
+			continue
+		}
+		key := expr.Key()
+		if !key.Next() {
+			continue
+		}
+		node := key.Node()
+		// nested array tables (e.g. [[variables.exec]]) belong to the previous one
+		if key.Next() {
+			continue
+		}
+		lines[string(node.Data)] = append(lines[string(node.Data)], p.Shape(node.Raw).Start.Line)
+	}
+	return lines
+}
+
+// tableLine returns the line of the table (e.g. [settings]) or 0 when not found.
+func tableLine(content []byte, name string) int {
+	p := unstable.Parser{}
+	p.Reset(content)
+	for p.NextExpression() {
+		expr := p.Expression()
+		if expr.Kind != unstable.Table {
+			continue
+		}
+		key := expr.Key()
+		if key.Next() && string(key.Node().Data) == name {
+			return p.Shape(key.Node().Raw).Start.Line
+		}
+	}
+	return 0
+}
@@ -0,0 +1,294 @@
+package validate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sj14/confible/internal/confible"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{
+			name: "valid",
+			content: `
+[settings]
+id = "valid"
+
+[[variables]]
+input = [{ var = "nick", prompt = "nick" }]
+
+[[config]]
+path = "/tmp/test"
+comment_symbol = "#"
+append = "{{ .Var.nick }}"
+`,
+		},
+		{
+			name: "syntax error",
+			content: `
+[settings]
+id = "syntax
+`,
+			want: []string{`test.toml:3:13: toml: basic strings cannot have new lines`},
+		},
+		{
+			name: "problems",
+			content: `
+[settings]
+os = ["linux", "macos"]
+
+[[snippet]]
+name = "s"
+text = "{{ .Var.fromSnippet }}"
+
+[[config]]
+path = "/tmp/test"
+comment_symbol = "#"
+perm_file = 0o1777
+append = """
+{{ .Var.age }}
+{{ template "s" . }}
+"""
+
+[[config]]
+path = "/tmp/test"
+arch = ["x86"]
+truncate = true
+foo = "bar"
+append = "{{ if }"
+`,
+			want: []string{
+				`test.toml:22:1: unknown field "config.foo"`,
+				`test.toml:2: missing id`,
+				`test.toml:2: settings: unknown os "macos"`,
+				`test.toml:5: snippet "s": s:1:7: undefined variable "fromSnippet"`,
+				`test.toml:9: [[config]] #1: invalid perm_file 01777`,
+				`test.toml:9: [[config]] #1: append:1:7: undefined variable "age"`,
+				`test.toml:18: [[config]] #2: missing comment symbol`,
+				`test.toml:18: [[config]] #2: unknown arch "x86"`,
+				`test.toml:18: [[config]] #2: template: append:1: unexpected "}" in if`,
+				`test.toml:18: [[config]] #2: "/tmp/test" should be truncated and also not be truncated`,
+				`test.toml:18: [[config]] #2: "/tmp/test" has perm_file -rwxrwxrwx and perm_file ----------`,
+			},
+		},
+		{
+			name: "on_change",
+			content: `
+[settings]
+id = "handlers"
+
+[[config]]
+name = "tmux-config"
+path = "~/.tmux.conf"
+comment_symbol = "#"
+append = "set -g mouse on"
+
+[[commands]]
+on_change = ["tmux-config", "~/.tmux.conf", "$HOME/.tmux.conf", "zsh-config"]
+needs = ["tpm", "unknown"]
+exec = ["tmux source-file ~/.tmux.conf"]
+
+[[commands]]
+name = "tpm"
+exec = ["git clone https://github.com/tmux-plugins/tpm ~/.tmux/plugins/tpm"]
+`,
+			want: []string{
+				`test.toml:11: [[commands]] #1: needs unknown commands "unknown"`,
+				`test.toml:11: [[commands]] #1: on_change references unknown config "zsh-config"`,
+			},
+		},
+		{
+			name: "nested array tables",
+			content: `
+[settings]
+id = "nested"
+
+[[variables]]
+[[variables.exec]]
+var = "home"
+cmd = "echo $HOME"
+[[variables.input]]
+var = "email"
+prompt = "your email"
+
+[[variables]]
+os = ["macos"]
+input = [{ var = "name", prompt = "your name" }]
+`,
+			want: []string{
+				`test.toml:13: [[variables]]: unknown os "macos"`,
+			},
+		},
+		{
+			name: "needs",
+			content: `
+[settings]
+id = "needs"
+
+[[commands]]
+name = "before"
+needs = ["after", "handler"]
+exec = ["true"]
+
+[[commands]]
+name = "after"
+after_configs = true
+needs = ["before"]
+exec = ["true"]
+
+[[commands]]
+name = "handler"
+on_change = ["config"]
+needs = ["after"]
+exec = ["true"]
+
+[[config]]
+name = "config"
+path = "/tmp/test"
+comment_symbol = "#"
+append = "test"
+`,
+			want: []string{
+				`test.toml:5: [[commands]] #1: needs "after", which runs after the configs`,
+				`test.toml:5: [[commands]] #1: needs "handler", which only runs on changes`,
+			},
+		},
+		{
+			name: "become",
+			content: `
+[settings]
+id = "become"
+
+[[config]]
+path = "/etc/hosts"
+sudo = true
+comment_symbol = "#"
+append = "127.0.0.1 example.local"
+
+[[config]]
+path = "/etc/hosts"
+comment_symbol = "#"
+append = "127.0.0.1 other.local"
+
+[[commands]]
+as_user = true
+become = "root"
+exec = ["apt-get update"]
+`,
+			want: []string{
+				`test.toml:11: [[config]] #2: "/etc/hosts" is written as user "root" and as user ""`,
+				`test.toml:16: [[commands]] #1: as_user can't be combined with sudo or become`,
+			},
+		},
+		{
+			name: "stdin and script",
+			content: `
+[settings]
+id = "script"
+
+[[variables]]
+input = [{ var = "name", prompt = "your name" }]
+
+[[commands]]
+stdin = "{{ .Var.name }} {{ .Var.age }}"
+exec = ["cat"]
+
+[[commands]]
+interpreter = "python3"
+exec = ["echo 'no script'"]
+`,
+			want: []string{
+				`test.toml:8: [[commands]] #1: stdin:1:23: undefined variable "age"`,
+				`test.toml:12: [[commands]] #2: interpreter without script`,
+			},
+		},
+		{
+			name: "command templates",
+			content: `
+[settings]
+id = "templates"
+
+[[variables]]
+input = [{ var = "email", prompt = "your email" }]
+exec = [{ var = "dir", cmd = "echo {{ .Var.home }}" }]
+
+[[commands]]
+exec = ["git config --global user.email {{ .Var.email | shellquote }}", "ls {{ .Var.dir }"]
+script = "echo {{ .Var.name }}"
+creates = "{{ .Var.dir }}/bin/{{ .Var.bin }}"
+unless = "test -x {{ .Var.bin }}"
+onlyif = "test -d {{ .Var.dir }"
+`,
+			want: []string{
+				`test.toml:5: [[variables]] #1: exec:1:12: undefined variable "home"`,
+				`test.toml:9: [[commands]] #1: template: exec:1: unexpected "}" in operand`,
+				`test.toml:9: [[commands]] #1: script:1:12: undefined variable "name"`,
+				`test.toml:9: [[commands]] #1: creates:1:26: undefined variable "bin"`,
+				`test.toml:9: [[commands]] #1: unless:1:15: undefined variable "bin"`,
+				`test.toml:9: [[commands]] #1: template: onlyif:1: unexpected "}" in operand`,
+			},
+		},
+		{
+			name: "unknown user",
+			content: `
+[settings]
+id = "users"
+templates = "~unknown-confible-user/templates"
+
+[[config]]
+path = "~unknown-confible-user/.bashrc"
+comment_symbol = "#"
+append = "alias ll='ls -l'"
+
+[[config]]
+path = "~{{ .Var.user }}/.bashrc"
+comment_symbol = "#"
+append = "alias ll='ls -l'"
+
+[[commands]]
+exec = ["true"]
+on_change = ["~unknown-confible-user/.bashrc"]
+`,
+			want: []string{
+				`test.toml:2: settings: failed expanding "~unknown-confible-user/templates": failed looking up user "unknown-confible-user": user: unknown user unknown-confible-user`,
+				`test.toml:6: [[config]] #1: failed expanding "~unknown-confible-user/.bashrc": failed looking up user "unknown-confible-user": user: unknown user unknown-confible-user`,
+				`test.toml:11: [[config]] #2: path:1:8: undefined variable "user"`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, problems := validate("test.toml", []byte(tt.content), confible.FormatTOML)
+
+			var got []string
+			for _, problem := range problems {
+				got = append(got, problem.String())
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.toml"), []byte("[settings]\nid = \"same\"\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b.yaml"), []byte("settings:\n  id: same\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte("# not a confible file\n"), 0o644))
+
+	var got []string
+	for _, problem := range Files([]string{dir, filepath.Join(dir, "missing.toml")}, "") {
+		got = append(got, problem.String())
+	}
+	require.Equal(t, []string{
+		fmt.Sprintf("%s: id %q is already used by %q", filepath.Join(dir, "b.yaml"), "same", filepath.Join(dir, "a.toml")),
+		fmt.Sprintf("%s: open %s: no such file or directory", filepath.Join(dir, "missing.toml"), filepath.Join(dir, "missing.toml")),
+	}, got)
+}
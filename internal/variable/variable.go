@@ -3,24 +3,27 @@ package variable
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/sj14/confible/internal/cache"
 	"github.com/sj14/confible/internal/command"
 	"github.com/sj14/confible/internal/confible"
+	"github.com/sj14/confible/internal/template"
 	"golang.org/x/exp/slices"
 )
 
-func Parse(id string, variables []confible.Variable, useCached bool, cacheFilepath string) (map[string]string, error) {
-	cacheInstance, err := cache.New(cacheFilepath)
-	if err != nil {
-		log.Fatalln(err)
-	}
-
+// Parse executes the commands and prompts for the inputs of the variables. The dir is the
+// default working directory of the commands, usually the directory of the confible file.
+// The commands are rendered with td and the variables which are known at that point.
+// The variables are stored in the cache c.
+// Running commands are killed and prompts are aborted when the context is done.
+func Parse(ctx context.Context, id string, variables []confible.Variable, useCached bool, cacheInstance *cache.Cache, dir string, td template.Data) (map[string]string, error) {
 	for _, variables := range variables {
 		// check if we can skip those variables
 		if len(variables.OSs) != 0 && !slices.Contains(variables.OSs, runtime.GOOS) {
@@ -33,9 +36,26 @@ func Parse(id string, variables []confible.Variable, useCached bool, cacheFilepa
 		}
 
 		for _, cmd := range variables.Exec {
+			td.Var = cacheInstance.LoadVars(id)
+			text, err := template.Render("exec", cmd.Cmd, td)
+			if err != nil {
+				return nil, fmt.Errorf("failed rendering command of variable %q: %v", cmd.VariableName, err)
+			}
+
+			workDir, err := command.WorkDir(dir, cmd.Dir, nil)
+			if err != nil {
+				return nil, fmt.Errorf("variable %q: %v", cmd.VariableName, err)
+			}
+
 			output := &bytes.Buffer{}
 
-			if err := command.ExecNoCache(cmd.Cmd, output); err != nil {
+			opts := command.Options{
+				Dir:     workDir,
+				Env:     cmd.Env,
+				Shell:   cmd.Shell,
+				Timeout: time.Duration(cmd.Timeout),
+			}
+			if err := command.ExecNoCache(ctx, text, output, opts); err != nil {
 				return nil, err
 			}
 
@@ -44,21 +64,27 @@ func Parse(id string, variables []confible.Variable, useCached bool, cacheFilepa
 
 		// variables from input
 		for _, input := range variables.Input {
+			cacheInstance.SetSecret(id, input.VariableName, input.Secret)
+
 			cachedValue := cacheInstance.LoadVar(id, input.VariableName)
+			shownValue := fmt.Sprintf("%q", cachedValue)
+			if input.Secret {
+				shownValue = "(secret)"
+			}
+
 			// no input given, use cached value (when enabled)
 			if cachedValue != "" && useCached {
 				cacheInstance.UpsertVar(id, input.VariableName, cachedValue)
-				log.Printf("[%v] using cached variable %q: %q", id, input.VariableName, cachedValue)
+				log.Printf("[%v] using cached variable %q: %s", id, input.VariableName, shownValue)
 				continue
 			}
 
-			reader := bufio.NewReader(os.Stdin)
 			fmt.Printf("manual input required: %q\n", input.Prompt)
 			if cachedValue != "" {
-				fmt.Printf("press enter to use the cached value: %q\n", cachedValue)
+				fmt.Printf("press enter to use the cached value: %s\n", shownValue)
 			}
 			fmt.Print("> ")
-			text, err := reader.ReadString('\n')
+			text, err := readLine(ctx)
 			if err != nil {
 				return nil, fmt.Errorf("failed reading variable input: %v", err)
 			}
@@ -70,5 +96,28 @@ func Parse(id string, variables []confible.Variable, useCached bool, cacheFilepa
 			cacheInstance.UpsertVar(id, input.VariableName, text)
 		}
 	}
-	return cacheInstance.LoadVars(id), cacheInstance.Store(cacheFilepath)
+	return cacheInstance.LoadVars(id), cacheInstance.Store()
+}
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// readLine reads a line from stdin or returns when the context is done.
+func readLine(ctx context.Context) (string, error) {
+	type result struct {
+		line string
+		err  error
+	}
+	// the read can't be interrupted, the goroutine ends when confible exits
+	c := make(chan result, 1)
+	go func() {
+		line, err := stdin.ReadString('\n')
+		c <- result{line, err}
+	}()
+
+	select {
+	case r := <-c:
+		return r.line, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
 }
@@ -1,17 +1,30 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/pelletier/go-toml/v2"
 	"github.com/sj14/confible/internal/cache"
 	"github.com/sj14/confible/internal/command"
 	"github.com/sj14/confible/internal/confible"
 	"github.com/sj14/confible/internal/config"
+	"github.com/sj14/confible/internal/graph"
+	"github.com/sj14/confible/internal/schema"
+	"github.com/sj14/confible/internal/source"
+	"github.com/sj14/confible/internal/utils"
+	"github.com/sj14/confible/internal/validate"
 	"golang.org/x/exp/slices"
 )
 
@@ -27,12 +40,19 @@ func main() {
 		applyCmds     = flag.Bool("apply-cmds", true, "exec commands")
 		applyCfgs     = flag.Bool("apply-cfgs", true, "apply configs")
 		cachedVars    = flag.Bool("cached-vars", true, "use the variables from the cache when present")
-		cachedCmds    = flag.Bool("cached-cmds", true, "don't execute commands when they didn't change since last execution")
+		cachedCmds    = flag.Bool("cached-cmds", true, "don't execute commands which were executed successfully before")
 		cleanID       = flag.Bool("clean", false, "give a confible file and it will remove the config from configured targets matching the config id")
-		cacheList     = flag.Bool("cache-list", false, "list the cached variables")
+		cacheList     = flag.Bool("cache-list", false, "list the cached variables, secret values are masked (see 'cache list')")
 		cachePrune    = flag.Bool("cache-prune", false, "remove the cache file used for all configs")
 		cacheClean    = flag.Bool("cache-clean", false, "remove the cache for the given configs")
 		cacheFilepath = flag.String("cache-file", cache.GetCacheFilepath(), "custom path to the cache file")
+		format        = flag.String("format", "", "format of the confible files (toml, yaml or json), detected by the file extension when empty")
+		strict        = flag.Bool("strict", false, "fail on missing template variables instead of rendering empty values (same as settings.strict)")
+		targetUser    = flag.String("user", "", "expand '~' and create files for this user instead of the current one (overrides settings.user)")
+		logDir        = flag.String("log-dir", "", "append the output of the commands to timestamped files in this directory")
+		quiet         = flag.Bool("quiet", false, "only show the output of failed commands")
+		jobs          = flag.Int("jobs", runtime.NumCPU(), "maximum number of parallel commands")
+		timeout       = flag.Duration("timeout", 0, "kill commands which run longer, unless they have a timeout set (0 for no timeout)")
 		// verbosity     = flag.Uint("verbosity", 1, "verbosity of the output (0-3)")
 		versionFlag = flag.Bool("version", false, fmt.Sprintf("print version information (%v)", version))
 	)
@@ -45,16 +65,49 @@ func main() {
 	}
 
 	if *cachePrune {
-		cache.Prune(*cacheFilepath)
+		if err := cache.Prune(*cacheFilepath); err != nil {
+			log.Fatalf("failed pruning cache: %v\n", err)
+		}
 	}
 
 	if *cacheList {
 		fmt.Printf("cache path: %s\n\n", *cacheFilepath)
-		c, err := cache.New(*cacheFilepath)
+		c, err := cache.Open(*cacheFilepath)
 		if err != nil {
 			log.Fatalf("failed opening cache: %v\n", err)
 		}
-		c.ListVars()
+		c.ListVars(os.Stdout, true)
+		c.Close()
+	}
+
+	switch confible.Format(*format) {
+	case "", confible.FormatTOML, confible.FormatYAML, confible.FormatJSON:
+	default:
+		log.Fatalf("unknown format %q\n", *format)
+	}
+
+	switch flag.Arg(0) {
+	case "validate":
+		problems := validate.Files(flag.Args()[1:], confible.Format(*format))
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) != 0 {
+			log.Fatalf("found %d problems\n", len(problems))
+		}
+		return
+	case "cache":
+		if err := runCache(*cacheFilepath, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	case "schema":
+		schema, err := schema.Generate()
+		if err != nil {
+			log.Fatalf("failed generating schema: %v\n", err)
+		}
+		fmt.Println(string(schema))
+		return
 	}
 
 	mode := config.ModeAppend
@@ -62,74 +115,335 @@ func main() {
 		mode = config.ModeCleanID
 	}
 
-	if err := processConfibleFiles(flag.Args(), *applyCmds, *applyCfgs, *cachedCmds, *cachedVars, *cacheClean, *cacheFilepath, mode); err != nil {
+	opts := options{
+		execCmds:      *applyCmds,
+		applyCfgs:     *applyCfgs,
+		cachedCmds:    *cachedCmds,
+		useCachedVars: *cachedVars,
+		cleanCache:    *cacheClean,
+		strict:        *strict,
+		cacheFilepath: *cacheFilepath,
+		targetUser:    *targetUser,
+		format:        confible.Format(*format),
+		timeout:       *timeout,
+		jobs:          *jobs,
+		logDir:        *logDir,
+		quiet:         *quiet,
+		started:       time.Now(),
+		mode:          mode,
+	}
+
+	// cancel the commands on Ctrl-C and stop before writing further targets
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		// a second Ctrl-C exits immediately
+		stop()
+	}()
+
+	err := processConfibleFiles(ctx, flag.Args(), opts)
+	stop()
+	if err != nil {
 		log.Fatalln(err)
 	}
 }
 
-func processConfibleFiles(configPaths []string, execCmds, applyCfgs, cachedCmds, useCachedVars, cleanCache bool, cacheFilepath string, mode config.ContentMode) error {
-	for _, configPath := range configPaths {
-		log.Printf("processing config %q\n", configPath)
+// options of a confible run, set by the flags
+type options struct {
+	execCmds      bool
+	applyCfgs     bool
+	cachedCmds    bool
+	useCachedVars bool
+	cleanCache    bool
+	strict        bool
+	cacheFilepath string
+	targetUser    string
+	format        confible.Format
+	timeout       time.Duration
+	jobs          int
+	logDir        string
+	quiet         bool
+	started       time.Time
+	mode          config.ContentMode
+}
+
+type confibleFile struct {
+	path string
+	file confible.File
+}
 
-		configFile, err := os.Open(configPath)
+func processConfibleFiles(ctx context.Context, configPaths []string, opts options) error {
+	configPaths, err := source.Expand(configPaths)
+	if err != nil {
+		return err
+	}
+
+	var files []confibleFile
+	for _, configPath := range configPaths {
+		cfg, err := readConfibleFile(configPath, opts.format)
 		if err != nil {
-			return fmt.Errorf("failed reading config %q: %v", configPath, err)
+			return err
 		}
+		files = append(files, confibleFile{path: configPath, file: cfg})
+	}
 
-		dec := toml.NewDecoder(configFile)
-		dec.DisallowUnknownFields()
+	files, err = sortConfibleFiles(files)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	// one cache for the whole run, other confible runs wait until it's closed
+	c, err := cache.Open(opts.cacheFilepath)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
 
-		cfg := confible.File{}
-		if err := dec.Decode(&cfg); err != nil {
-			return fmt.Errorf("failed unmarshalling config file: %v", err)
+	// key == id of a file which failed or was skipped because a requirement failed
+	failed := make(map[string]bool)
+	var errs, ignored []error
+	defer func() {
+		// summary of the failed commands with ignore_errors
+		if len(ignored) != 0 {
+			log.Printf("ignored %d failed commands:\n%v\n", len(ignored), errors.Join(ignored...))
 		}
+	}()
 
-		// check if we can skip this file
-		if len(cfg.Settings.OSs) != 0 && !slices.Contains(cfg.Settings.OSs, runtime.GOOS) {
-			log.Printf("[%v] skipping as operating system %q is not matching settings filter %q\n", cfg.Settings.ID, runtime.GOOS, cfg.Settings.OSs)
-			continue
+	for i, f := range files {
+		if err := ctx.Err(); err != nil {
+			return errors.Join(append(errs, fmt.Errorf("stopped before processing the remaining %d files: %w", len(files)-i, err))...)
 		}
-		if len(cfg.Settings.Archs) != 0 && !slices.Contains(cfg.Settings.Archs, runtime.GOARCH) {
-			log.Printf("[%v] skipping as machine arch %q is not matching settings filter %q\n", cfg.Settings.ID, runtime.GOARCH, cfg.Settings.Archs)
+
+		if id, ok := failedRequirement(f.file.Settings, failed); ok {
+			log.Printf("[%v] skipping as required %q failed\n", f.file.Settings.ID, id)
+			failed[f.file.Settings.ID] = true
 			continue
 		}
 
-		if cfg.Settings.ID == "" {
-			return fmt.Errorf("missing ID for %q", configPath)
+		fileIgnored, err := processConfibleFile(ctx, f.path, f.file, c, opts)
+		for _, e := range fileIgnored {
+			ignored = append(ignored, fmt.Errorf("[%v] %w", f.file.Settings.ID, e))
 		}
-
-		cfgmode := mode
-		if cfg.Settings.Deactivated {
-			log.Printf("[%v] cleaning configs as 'deactivated' is set\n", cfg.Settings.ID)
-			cfgmode = config.ModeCleanID
+		if err != nil {
+			if len(files) == 1 {
+				return err
+			}
+			// continue with the files which don't require the failed one
+			log.Printf("[%v] failed: %v\n", f.file.Settings.ID, err)
+			failed[f.file.Settings.ID] = true
+			errs = append(errs, fmt.Errorf("%s: %w", f.path, err))
 		}
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("%d of %d files failed:\n%w", len(errs), len(files), errors.Join(errs...))
+	}
+	return nil
+}
+
+func readConfibleFile(configPath string, format confible.Format) (confible.File, error) {
+	content, err := source.ReadFile(configPath)
+	if err != nil {
+		return confible.File{}, fmt.Errorf("failed reading config %q: %v", configPath, err)
+	}
 
-		if cleanCache {
-			log.Printf("[%v] cleaning cache\n", cfg.Settings.ID)
-			if err := cache.Clean(cacheFilepath, cfg.Settings.ID); err != nil {
-				log.Printf("failed to clean cache for %s\n", cfg.Settings.ID)
+	if format == "" {
+		format = confible.FormatFromPath(configPath)
+	}
+
+	return confible.Decode(bytes.NewReader(content), format)
+}
+
+// sortConfibleFiles orders the files based on settings.after and settings.requires.
+func sortConfibleFiles(files []confibleFile) ([]confibleFile, error) {
+	// the nodes are the indexes as IDs don't have to be unique or set
+	var nodes []string
+	indexes := make(map[string][]string)
+	for i, f := range files {
+		node := strconv.Itoa(i)
+		nodes = append(nodes, node)
+		indexes[f.file.Settings.ID] = append(indexes[f.file.Settings.ID], node)
+	}
+
+	deps := make(map[string][]string)
+	for i, f := range files {
+		for _, id := range f.file.Settings.Requires {
+			if len(indexes[id]) == 0 {
+				return nil, fmt.Errorf("[%v] requires %q, which is not part of the given files", f.file.Settings.ID, id)
 			}
 		}
+		for _, id := range append(f.file.Settings.After, f.file.Settings.Requires...) {
+			deps[nodes[i]] = append(deps[nodes[i]], indexes[id]...)
+		}
+	}
 
-		// commands which should run before the configs were written
-		if execCmds && cfgmode == config.ModeAppend {
-			if err := command.Exec(cfg.Settings.ID, command.Extract(cfg.Commands, false), cachedCmds, cacheFilepath); err != nil {
-				return err
-			}
+	sorted, err := graph.Sort(nodes, deps)
+	var cycleErr *graph.CycleError
+	if errors.As(err, &cycleErr) {
+		// replace the indexes with the ids of the files
+		var ids []string
+		for _, node := range cycleErr.Cycle {
+			i, _ := strconv.Atoi(node)
+			ids = append(ids, strconv.Quote(files[i].file.Settings.ID))
 		}
+		return nil, fmt.Errorf("dependency cycle: %s", strings.Join(ids, " -> "))
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		if applyCfgs {
-			if err := config.ModifyTargetFiles(cfg, useCachedVars, cacheFilepath, cfgmode); err != nil {
-				return err
-			}
+	result := make([]confibleFile, 0, len(files))
+	for _, node := range sorted {
+		i, _ := strconv.Atoi(node)
+		result = append(result, files[i])
+	}
+	return result, nil
+}
+
+// failedRequirement returns the first required id which failed.
+func failedRequirement(settings confible.Settings, failed map[string]bool) (string, bool) {
+	for _, id := range settings.Requires {
+		if failed[id] {
+			return id, true
 		}
+	}
+	return "", false
+}
 
-		// commands which should run after the configs were written
-		if execCmds && cfgmode == config.ModeAppend {
-			if err := command.Exec(cfg.Settings.ID, command.Extract(cfg.Commands, true), cachedCmds, cacheFilepath); err != nil {
-				return err
+// processConfibleFile applies the confible file and returns the ignored errors of the commands.
+func processConfibleFile(ctx context.Context, configPath string, cfg confible.File, c *cache.Cache, opts options) ([]error, error) {
+	log.Printf("processing config %q\n", configPath)
+
+	// check if we can skip this file
+	if len(cfg.Settings.OSs) != 0 && !slices.Contains(cfg.Settings.OSs, runtime.GOOS) {
+		log.Printf("[%v] skipping as operating system %q is not matching settings filter %q\n", cfg.Settings.ID, runtime.GOOS, cfg.Settings.OSs)
+		return nil, nil
+	}
+	if len(cfg.Settings.Archs) != 0 && !slices.Contains(cfg.Settings.Archs, runtime.GOARCH) {
+		log.Printf("[%v] skipping as machine arch %q is not matching settings filter %q\n", cfg.Settings.ID, runtime.GOARCH, cfg.Settings.Archs)
+		return nil, nil
+	}
+
+	if cfg.Settings.ID == "" {
+		return nil, fmt.Errorf("missing ID for %q", configPath)
+	}
+
+	if opts.strict {
+		cfg.Settings.Strict = true
+	}
+
+	templates, err := cfg.Settings.TemplatesDir(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("[%v] %v", cfg.Settings.ID, err)
+	}
+	cfg.Settings.Templates = templates
+
+	if opts.timeout > 0 {
+		setDefaultTimeout(&cfg, confible.Duration(opts.timeout))
+	}
+
+	username := cfg.Settings.User
+	if opts.targetUser != "" {
+		username = opts.targetUser
+	}
+	usr, err := utils.LookupUser(username)
+	if err != nil {
+		return nil, fmt.Errorf("[%v] %v", cfg.Settings.ID, err)
+	}
+
+	cfgmode := opts.mode
+	if cfg.Settings.Deactivated {
+		log.Printf("[%v] cleaning configs as 'deactivated' is set\n", cfg.Settings.ID)
+		cfgmode = config.ModeCleanID
+	}
+
+	if opts.cleanCache {
+		log.Printf("[%v] cleaning cache\n", cfg.Settings.ID)
+		if err := c.Clean(cfg.Settings.ID); err != nil {
+			log.Printf("failed to clean cache for %s\n", cfg.Settings.ID)
+		}
+	}
+
+	var ignored []error
+
+	execOpts := command.ExecOptions{
+		UseCache: opts.cachedCmds,
+		Cache:    c,
+		Dir:      source.Dir(configPath),
+		Jobs:     opts.jobs,
+		Quiet:    opts.quiet,
+		User:     usr,
+	}
+	if opts.logDir != "" {
+		// e.g. vim-20231224-180000.log
+		name := fmt.Sprintf("%s-%s.log", strings.ReplaceAll(cfg.Settings.ID, string(filepath.Separator), "_"), opts.started.Format("20060102-150405"))
+		logDir, err := utils.AbsFilepath(opts.logDir, nil)
+		if err != nil {
+			return nil, err
+		}
+		execOpts.Log = filepath.Join(logDir, name)
+	}
+
+	// the variables are parsed before any command runs, the commands can use them
+	if opts.applyCfgs || (opts.execCmds && cfgmode == config.ModeAppend) {
+		execOpts.Data, err = config.TemplateData(ctx, configPath, cfg, opts.useCachedVars, c, cfgmode, usr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// commands which should run before the configs were written
+	if opts.execCmds && cfgmode == config.ModeAppend {
+		cmdIgnored, err := command.Exec(ctx, cfg.Settings.ID, command.Extract(cfg.Commands, false), execOpts)
+		ignored = append(ignored, cmdIgnored...)
+		if err != nil {
+			return ignored, err
+		}
+	}
+
+	var changed []string
+	if opts.applyCfgs {
+		changed, err = config.ModifyTargetFiles(ctx, configPath, cfg, execOpts.Data, cfgmode, usr)
+		if err != nil {
+			return ignored, err
+		}
+	}
+
+	// commands which should run after the configs were written
+	if opts.execCmds && cfgmode == config.ModeAppend {
+		cmdIgnored, err := command.Exec(ctx, cfg.Settings.ID, command.Extract(cfg.Commands, true), execOpts)
+		ignored = append(ignored, cmdIgnored...)
+		if err != nil {
+			return ignored, err
+		}
+
+		// handlers run on every change, independent of the cache
+		handlerOpts := execOpts
+		handlerOpts.UseCache = false
+		cmdIgnored, err = command.Exec(ctx, cfg.Settings.ID, command.Triggered(cfg.Commands, changed, usr), handlerOpts)
+		ignored = append(ignored, cmdIgnored...)
+		if err != nil {
+			return ignored, err
+		}
+	}
+	return ignored, nil
+}
+
+// setDefaultTimeout sets the timeout of the commands and variable commands without a timeout.
+func setDefaultTimeout(cfg *confible.File, timeout confible.Duration) {
+	for i := range cfg.Commands {
+		if cfg.Commands[i].Timeout == 0 {
+			cfg.Commands[i].Timeout = timeout
+		}
+	}
+	for i := range cfg.Variables {
+		for j := range cfg.Variables[i].Exec {
+			if cfg.Variables[i].Exec[j].Timeout == 0 {
+				cfg.Variables[i].Exec[j].Timeout = timeout
 			}
 		}
 	}
-	return nil
 }